@@ -14,10 +14,14 @@ import (
 )
 
 type CityLine struct {
-	Start    rl.Vector2
-	End      rl.Vector2
-	Type     InfrastructureType
-	PlayerID string
+	Start      rl.Vector2
+	End        rl.Vector2
+	Type       InfrastructureType
+	PlayerID   string
+	Class      RoadClass
+	OneWay     bool
+	Crossing   CrossingType
+	Congestion float32
 }
 
 type PlayerCursor struct {
@@ -34,9 +38,23 @@ type LobbyClient struct {
 	OtherCursors map[string]PlayerCursor
 	CityLines    []CityLine
 	Buildings    []Building
+	Zones        []Zone
 	BusRoutes    []BusRoute
+	BusStops     []BusStop
 	Buses        []Bus
 	Money        float32
+	Demand       [3]float32
+	Population   int
+	Workforce    int
+	Employed     int
+	Jobs         int
+	Commuters    [numCommuteModes]int
+	AvgCommute   float32
+	Trucks       []rl.Vector2
+	Goods        [3]int
+	Heatmaps     [numHeatmapKinds]map[int]float32
+	TaxRate      int
+	Rating       int
 }
 
 func (c *LobbyClient) Connect(ip string, port int, playerName string) {
@@ -53,7 +71,9 @@ func (c *LobbyClient) Connect(ip string, port int, playerName string) {
 	c.OtherCursors = make(map[string]PlayerCursor)
 	c.CityLines = make([]CityLine, 0)
 	c.Buildings = make([]Building, 0)
+	c.Zones = make([]Zone, 0)
 	c.BusRoutes = make([]BusRoute, 0)
+	c.BusStops = make([]BusStop, 0)
 	c.Buses = make([]Bus, 0)
 	c.Money = 0.0
 
@@ -95,12 +115,16 @@ func (c *LobbyClient) SendCursor(x, y float32) {
 	}
 }
 
-func (c *LobbyClient) SendInfrastructure(startX, startY, endX, endY float32, infraType InfrastructureType) {
+func (c *LobbyClient) SendInfrastructure(startX, startY, endX, endY float32, infraType InfrastructureType, class RoadClass, oneWay bool, crossing CrossingType) {
 	if !c.Connected {
 		return
 	}
-	msg := fmt.Sprintf("I:%s:%.0f:%.0f:%.0f:%.0f:%d\n",
-		c.clientID, startX, startY, endX, endY, int(infraType))
+	oneWayFlag := 0
+	if oneWay {
+		oneWayFlag = 1
+	}
+	msg := fmt.Sprintf("I:%s:%.0f:%.0f:%.0f:%.0f:%d:%d:%d:%d\n",
+		c.clientID, startX, startY, endX, endY, int(infraType), int(class), oneWayFlag, int(crossing))
 	_, err := c.conn.Write([]byte(msg))
 	if err != nil {
 		c.Disconnect()
@@ -119,7 +143,19 @@ func (c *LobbyClient) SendBuilding(x, y float32, buildingType BuildingType) {
 	}
 }
 
-func (c *LobbyClient) SendBusRoute(nodes []rl.Vector2) {
+func (c *LobbyClient) SendZone(startX, startY, endX, endY float32, zoneType BuildingType) {
+	if !c.Connected {
+		return
+	}
+	msg := fmt.Sprintf("Z:%s:%.0f:%.0f:%.0f:%.0f:%d\n",
+		c.clientID, startX, startY, endX, endY, int(zoneType))
+	_, err := c.conn.Write([]byte(msg))
+	if err != nil {
+		c.Disconnect()
+	}
+}
+
+func (c *LobbyClient) SendBusRoute(nodes []rl.Vector2, loop bool, mode TransitMode) {
 	if !c.Connected || len(nodes) < 2 {
 		return
 	}
@@ -127,6 +163,12 @@ func (c *LobbyClient) SendBusRoute(nodes []rl.Vector2) {
 	var sb strings.Builder
 	sb.WriteString("R:")
 	sb.WriteString(c.clientID)
+	if loop {
+		sb.WriteString(":1")
+	} else {
+		sb.WriteString(":0")
+	}
+	sb.WriteString(fmt.Sprintf(":%d", mode))
 	for _, node := range nodes {
 		sb.WriteString(fmt.Sprintf(":%.0f:%.0f", node.X, node.Y))
 	}
@@ -139,6 +181,90 @@ func (c *LobbyClient) SendBusRoute(nodes []rl.Vector2) {
 	}
 }
 
+func (c *LobbyClient) SendBusStop(x, y float32) {
+	if !c.Connected {
+		return
+	}
+	msg := fmt.Sprintf("S:%s:%.0f:%.0f\n", c.clientID, x, y)
+	_, err := c.conn.Write([]byte(msg))
+	if err != nil {
+		c.Disconnect()
+	}
+}
+
+func (c *LobbyClient) SendTaxRate(rate int) {
+	if !c.Connected {
+		return
+	}
+	msg := fmt.Sprintf("TAX:%s:%d\n", c.clientID, rate)
+	_, err := c.conn.Write([]byte(msg))
+	if err != nil {
+		c.Disconnect()
+	}
+}
+
+func (c *LobbyClient) SendRouteVehicles(routeID, vehicles int) {
+	if !c.Connected {
+		return
+	}
+	msg := fmt.Sprintf("RV:%s:%d:%d\n", c.clientID, routeID, vehicles)
+	_, err := c.conn.Write([]byte(msg))
+	if err != nil {
+		c.Disconnect()
+	}
+}
+
+func (c *LobbyClient) SendRouteEdit(routeID int, nodes []rl.Vector2) {
+	if !c.Connected || len(nodes) < 2 {
+		return
+	}
+
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("RE:%s:%d", c.clientID, routeID))
+	for _, node := range nodes {
+		sb.WriteString(fmt.Sprintf(":%.0f:%.0f", node.X, node.Y))
+	}
+	sb.WriteString("\n")
+
+	_, err := c.conn.Write([]byte(sb.String()))
+	if err != nil {
+		c.Disconnect()
+	}
+}
+
+func (c *LobbyClient) SendRouteName(routeID int, name string) {
+	if !c.Connected {
+		return
+	}
+	msg := fmt.Sprintf("RNAME:%s:%d:%s\n", c.clientID, routeID, strings.ReplaceAll(name, ":", ""))
+	_, err := c.conn.Write([]byte(msg))
+	if err != nil {
+		c.Disconnect()
+	}
+}
+
+func (c *LobbyClient) SendRouteColor(routeID int, color int) {
+	if !c.Connected {
+		return
+	}
+	msg := fmt.Sprintf("RCOLOR:%s:%d:%d\n", c.clientID, routeID, color)
+	_, err := c.conn.Write([]byte(msg))
+	if err != nil {
+		c.Disconnect()
+	}
+}
+
+func (c *LobbyClient) SendUpgrade(x, y float32) {
+	if !c.Connected {
+		return
+	}
+	msg := fmt.Sprintf("UP:%s:%.0f:%.0f\n", c.clientID, x, y)
+	_, err := c.conn.Write([]byte(msg))
+	if err != nil {
+		c.Disconnect()
+	}
+}
+
 func (c *LobbyClient) SendDelete(x, y float32) {
 	if !c.Connected {
 		return
@@ -203,23 +329,30 @@ func (c *LobbyClient) listen() {
 		case "STATE_RESET":
 			c.CityLines = make([]CityLine, 0)
 			c.Buildings = make([]Building, 0)
+			c.Zones = make([]Zone, 0)
 			c.BusRoutes = make([]BusRoute, 0)
+			c.BusStops = make([]BusStop, 0)
 			c.Buses = make([]Bus, 0)
 		case "I":
-			if len(parts) == 7 {
+			if len(parts) == 10 {
 				playerID := parts[1]
 				startX, errSX := strconv.ParseFloat(parts[2], 32)
 				startY, errSY := strconv.ParseFloat(parts[3], 32)
 				endX, errEX := strconv.ParseFloat(parts[4], 32)
 				endY, errEY := strconv.ParseFloat(parts[5], 32)
 				infraType, errIT := strconv.Atoi(parts[6])
+				class, errC := strconv.Atoi(parts[7])
+				crossing, errCr := strconv.Atoi(parts[9])
 
-				if !(errSX != nil || errSY != nil || errEX != nil || errEY != nil || errIT != nil) {
+				if !(errSX != nil || errSY != nil || errEX != nil || errEY != nil || errIT != nil || errC != nil || errCr != nil) {
 					newLine := CityLine{
 						Start:    rl.NewVector2(float32(startX), float32(startY)),
 						End:      rl.NewVector2(float32(endX), float32(endY)),
 						Type:     InfrastructureType(infraType),
 						PlayerID: playerID,
+						Class:    RoadClass(class),
+						OneWay:   parts[8] == "1",
+						Crossing: CrossingType(crossing),
 					}
 					c.CityLines = append(c.CityLines, newLine)
 				}
@@ -236,18 +369,69 @@ func (c *LobbyClient) listen() {
 						Position: rl.NewVector2(float32(x), float32(y)),
 						Type:     BuildingType(buildingType),
 						PlayerID: playerID,
+						Level:    1,
 					}
 					c.Buildings = append(c.Buildings, newBuilding)
 				} else {
 				}
 			} else {
 			}
+		case "BSTATUS":
+			if len(parts) == 12 {
+				index, errIdx := strconv.Atoi(parts[1])
+				connected, errC := strconv.Atoi(parts[2])
+				occupants, errO := strconv.Atoi(parts[3])
+				capacity, errCap := strconv.Atoi(parts[4])
+				watered, errW := strconv.Atoi(parts[5])
+				powered, errPw := strconv.Atoi(parts[6])
+				supply, errS := strconv.Atoi(parts[7])
+				happiness, errH := strconv.Atoi(parts[8])
+				abandoned, errA := strconv.Atoi(parts[9])
+				decay, errD := strconv.Atoi(parts[10])
+				level, errL := strconv.Atoi(parts[11])
+				if errIdx == nil && errC == nil && errO == nil && errCap == nil && errW == nil && errPw == nil && errS == nil && errH == nil && errA == nil && errD == nil && errL == nil && index >= 0 && index < len(c.Buildings) {
+					c.Buildings[index].Connected = connected == 1
+					c.Buildings[index].Occupants = occupants
+					c.Buildings[index].Capacity = capacity
+					c.Buildings[index].Watered = watered == 1
+					c.Buildings[index].Powered = powered == 1
+					c.Buildings[index].Supply = float32(supply) / 100
+					c.Buildings[index].Happiness = float32(happiness) / 100
+					c.Buildings[index].Abandoned = abandoned == 1
+					c.Buildings[index].Decay = float32(decay) / 100
+					c.Buildings[index].Level = level
+				} else {
+				}
+			} else {
+			}
+		case "ZONE":
+			if len(parts) == 5 {
+				playerID := parts[1]
+				x, errX := strconv.ParseFloat(parts[2], 32)
+				y, errY := strconv.ParseFloat(parts[3], 32)
+				zoneType, errZT := strconv.Atoi(parts[4])
+				if errX == nil && errY == nil && errZT == nil {
+					position := rl.NewVector2(float32(x), float32(y))
+					for i := len(c.Zones) - 1; i >= 0; i-- {
+						if c.Zones[i].Position == position {
+							c.Zones = append(c.Zones[:i], c.Zones[i+1:]...)
+						}
+					}
+					if BuildingType(zoneType) != NoZone {
+						c.Zones = append(c.Zones, Zone{Position: position, Type: BuildingType(zoneType), PlayerID: playerID})
+					}
+				} else {
+				}
+			} else {
+			}
 		case "R":
-			if len(parts) >= 6 && (len(parts)-2)%2 == 0 {
+			if len(parts) >= 8 && (len(parts)-4)%2 == 0 {
 				playerID := parts[1]
-				nodes := make([]rl.Vector2, 0, (len(parts)-2)/2)
-				allParsed := true
-				for i := 2; i < len(parts); i += 2 {
+				loop := parts[2] == "1"
+				mode, errM := strconv.Atoi(parts[3])
+				nodes := make([]rl.Vector2, 0, (len(parts)-4)/2)
+				allParsed := errM == nil
+				for i := 4; i < len(parts); i += 2 {
 					x, errX := strconv.ParseFloat(parts[i], 32)
 					y, errY := strconv.ParseFloat(parts[i+1], 32)
 					if errX == nil && errY == nil {
@@ -258,25 +442,200 @@ func (c *LobbyClient) listen() {
 					}
 				}
 				if allParsed && len(nodes) >= 2 {
-					newRoute := BusRoute{Nodes: nodes, PlayerID: playerID, Length: 0}
+					newRoute := BusRoute{Nodes: nodes, PlayerID: playerID, Length: 0, Loop: loop, Mode: TransitMode(mode)}
 					c.BusRoutes = append(c.BusRoutes, newRoute)
 				} else if !allParsed {
 				}
 			} else {
 			}
 		case "BUS":
-			if len(parts) == 4 {
+			if len(parts) == 5 {
 				busID, errID := strconv.Atoi(parts[1])
 				x, errX := strconv.ParseFloat(parts[2], 32)
 				y, errY := strconv.ParseFloat(parts[3], 32)
+				routeID, errR := strconv.Atoi(parts[4])
 
-				if errID == nil && errX == nil && errY == nil {
+				if errID == nil && errX == nil && errY == nil && errR == nil {
 
 					for len(c.Buses) <= busID {
 						c.Buses = append(c.Buses, Bus{})
 					}
 					c.Buses[busID].Position = rl.NewVector2(float32(x), float32(y))
-					c.Buses[busID].RouteID = busID
+					c.Buses[busID].RouteID = routeID
+				} else {
+				}
+			} else {
+			}
+		case "DEMAND":
+			if len(parts) == 4 {
+				for i := 0; i < 3; i++ {
+					value, err := strconv.ParseFloat(parts[i+1], 32)
+					if err == nil {
+						c.Demand[i] = float32(value)
+					}
+				}
+			} else {
+			}
+		case "TRAFFIC":
+			if len(parts) == 2 && parts[1] != "" {
+				ratios := strings.Split(parts[1], ",")
+				for i := 0; i < len(ratios) && i < len(c.CityLines); i++ {
+					ratio, err := strconv.ParseFloat(ratios[i], 32)
+					if err == nil {
+						c.CityLines[i].Congestion = float32(ratio)
+					}
+				}
+			} else {
+			}
+		case "STATS":
+			if len(parts) == 5 {
+				population, errP := strconv.Atoi(parts[1])
+				workforce, errW := strconv.Atoi(parts[2])
+				employed, errE := strconv.Atoi(parts[3])
+				jobs, errJ := strconv.Atoi(parts[4])
+				if errP == nil && errW == nil && errE == nil && errJ == nil {
+					c.Population = population
+					c.Workforce = workforce
+					c.Employed = employed
+					c.Jobs = jobs
+				} else {
+				}
+			} else {
+			}
+		case "HEAT":
+			if len(parts) == 3 {
+				kind, errK := strconv.Atoi(parts[1])
+				if errK == nil && kind >= 0 && kind < int(numHeatmapKinds) {
+					heatmap := make(map[int]float32)
+					for _, entry := range strings.Split(parts[2], ",") {
+						cell, value, found := strings.Cut(entry, "=")
+						if !found {
+							continue
+						}
+						index, errI := strconv.Atoi(cell)
+						v, errV := strconv.ParseFloat(value, 32)
+						if errI == nil && errV == nil {
+							heatmap[index] = float32(v)
+						}
+					}
+					c.Heatmaps[kind] = heatmap
+				} else {
+				}
+			} else {
+			}
+		case "TRUCKS":
+			if len(parts) == 2 {
+				c.Trucks = c.Trucks[:0]
+				for _, position := range strings.Split(parts[1], ";") {
+					coords := strings.Split(position, ",")
+					if len(coords) != 2 {
+						continue
+					}
+					x, errX := strconv.ParseFloat(coords[0], 32)
+					y, errY := strconv.ParseFloat(coords[1], 32)
+					if errX == nil && errY == nil {
+						c.Trucks = append(c.Trucks, rl.NewVector2(float32(x), float32(y)))
+					}
+				}
+			} else {
+			}
+		case "GOODS":
+			if len(parts) == 4 {
+				produced, errP := strconv.Atoi(parts[1])
+				delivered, errD := strconv.Atoi(parts[2])
+				exported, errE := strconv.Atoi(parts[3])
+				if errP == nil && errD == nil && errE == nil {
+					c.Goods = [3]int{produced, delivered, exported}
+				} else {
+				}
+			} else {
+			}
+		case "COMMUTE":
+			if len(parts) == 5 {
+				walk, errW := strconv.Atoi(parts[1])
+				drive, errD := strconv.Atoi(parts[2])
+				transit, errT := strconv.Atoi(parts[3])
+				avg, errA := strconv.ParseFloat(parts[4], 32)
+				if errW == nil && errD == nil && errT == nil && errA == nil {
+					c.Commuters = [numCommuteModes]int{walk, drive, transit}
+					c.AvgCommute = float32(avg)
+				} else {
+				}
+			} else {
+			}
+		case "STOP":
+			if len(parts) == 4 {
+				x, errX := strconv.ParseFloat(parts[1], 32)
+				y, errY := strconv.ParseFloat(parts[2], 32)
+				waiting, errW := strconv.Atoi(parts[3])
+				if errX == nil && errY == nil && errW == nil {
+					position := rl.NewVector2(float32(x), float32(y))
+					found := false
+					for i := len(c.BusStops) - 1; i >= 0; i-- {
+						if c.BusStops[i].Position == position {
+							found = true
+							if waiting < 0 {
+								c.BusStops = append(c.BusStops[:i], c.BusStops[i+1:]...)
+							} else {
+								c.BusStops[i].Waiting = waiting
+							}
+						}
+					}
+					if !found && waiting >= 0 {
+						c.BusStops = append(c.BusStops, BusStop{Position: position, Waiting: waiting})
+					}
+				} else {
+				}
+			} else {
+			}
+		case "RINFO":
+			if len(parts) == 6 {
+				routeID, errID := strconv.Atoi(parts[1])
+				id, errI := strconv.Atoi(parts[2])
+				color, errC := strconv.Atoi(parts[3])
+				if errID == nil && errI == nil && errC == nil && routeID >= 0 && routeID < len(c.BusRoutes) {
+					c.BusRoutes[routeID].ID = id
+					c.BusRoutes[routeID].Color = color
+					c.BusRoutes[routeID].Owner = parts[4]
+					c.BusRoutes[routeID].Name = parts[5]
+				} else {
+				}
+			} else {
+			}
+		case "RSTATS":
+			if len(parts) == 8 {
+				routeID, errID := strconv.Atoi(parts[1])
+				riders, errR := strconv.Atoi(parts[2])
+				revenue, errRev := strconv.ParseFloat(parts[3], 32)
+				vehicles, errV := strconv.Atoi(parts[4])
+				opCost, errOp := strconv.ParseFloat(parts[5], 32)
+				trips, errT := strconv.Atoi(parts[6])
+				length, errL := strconv.ParseFloat(parts[7], 32)
+				if errID == nil && errR == nil && errRev == nil && errV == nil && errOp == nil && errT == nil && errL == nil && routeID >= 0 && routeID < len(c.BusRoutes) {
+					c.BusRoutes[routeID].Riders = riders
+					c.BusRoutes[routeID].Revenue = float32(revenue)
+					c.BusRoutes[routeID].Vehicles = vehicles
+					c.BusRoutes[routeID].OpCost = float32(opCost)
+					c.BusRoutes[routeID].Trips = trips
+					c.BusRoutes[routeID].Length = float32(length)
+				} else {
+				}
+			} else {
+			}
+		case "TAXRATE":
+			if len(parts) == 2 {
+				rate, err := strconv.Atoi(parts[1])
+				if err == nil {
+					c.TaxRate = rate
+				} else {
+				}
+			} else {
+			}
+		case "RATING":
+			if len(parts) == 2 {
+				rating, err := strconv.Atoi(parts[1])
+				if err == nil {
+					c.Rating = rating
 				} else {
 				}
 			} else {
@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"math"
 	"strconv"
 
 	gui "github.com/gen2brain/raylib-go/raygui"
@@ -23,6 +24,33 @@ const (
 	BuildingMode
 	BusRouteMode
 	DeleteMode
+	ZoningMode
+)
+
+type RouteTool int
+
+const (
+	NewRouteTool RouteTool = iota
+	StopTool
+	EditRouteTool
+)
+
+type OverlayMode int
+
+const (
+	NoOverlay OverlayMode = iota
+	WaterOverlay
+	PowerOverlay
+	TrafficOverlay
+	GoodsOverlay
+	PollutionOverlay
+	NoiseOverlay
+	LandValueOverlay
+	PoliceOverlay
+	FireOverlay
+	HealthOverlay
+	EducationOverlay
+	numOverlayModes
 )
 
 var (
@@ -42,16 +70,35 @@ var (
 	isBuilding          bool
 	buildStart          rl.Vector2
 	currentInfraType    InfrastructureType
+	currentRoadClass    RoadClass
+	isOneWay            bool
+	useTunnels          bool
 	currentBuildingType BuildingType
 	currentBuildMode    BuildMode = InfrastructureMode
-	showGrid            bool      = true
+	currentOverlay      OverlayMode
+	showGrid            bool = true
 	cameraOffset        rl.Vector2
 	zoom                float32 = 1.0
 
 	isCreatingBusRoute bool
 	currentRouteNodes  []rl.Vector2
+	currentRouteTool   RouteTool
+	currentTransitMode TransitMode
+	selectedRoute      int
+	draggedRouteNode   = -1
+	showRoutesPanel    bool
+	hiddenRoutes       = make(map[int]bool)
+
+	isZoning        bool
+	zoneStart       rl.Vector2
+	currentZoneType BuildingType
+
+	isInspecting      bool
+	inspectedBuilding rl.Vector2
 )
 
+var buildingInspectorRect = rl.NewRectangle(10, UI_HEIGHT+50, 220, 200)
+
 var ipBox = CustomTextBox{
 	Rect:      rl.NewRectangle(200, 200, 250, 30),
 	Text:      ipInput,
@@ -62,6 +109,13 @@ var portBox = CustomTextBox{
 	Text:      portInput,
 	MaxLength: 6,
 }
+var routeNameBox = CustomTextBox{
+	Rect:      rl.NewRectangle(300, 40, 150, 25),
+	MaxLength: MAX_ROUTE_NAME_LENGTH,
+}
+
+var routeColors = [NUM_ROUTE_COLORS]rl.Color{rl.Orange, rl.Purple, rl.DarkGreen, rl.Maroon, rl.Pink, rl.Lime, rl.Violet, rl.Brown}
+
 var nameBox = CustomTextBox{
 	Rect:      rl.NewRectangle(200, 160, 250, 30),
 	Text:      playerName,
@@ -173,17 +227,25 @@ func update(delta float32) {
 	case InGame:
 		mousePos := rl.GetMousePosition()
 
-		if rl.IsKeyDown(rl.KeyA) || rl.IsKeyDown(rl.KeyLeft) {
-			cameraOffset.X += 1000 * delta
-		}
-		if rl.IsKeyDown(rl.KeyD) || rl.IsKeyDown(rl.KeyRight) {
-			cameraOffset.X -= 1000 * delta
-		}
-		if rl.IsKeyDown(rl.KeyW) || rl.IsKeyDown(rl.KeyUp) {
-			cameraOffset.Y += 1000 * delta
+		if currentBuildMode == BusRouteMode && currentRouteTool == EditRouteTool {
+			routeNameBox.Update()
+		} else {
+			routeNameBox.Focused = false
 		}
-		if rl.IsKeyDown(rl.KeyS) || rl.IsKeyDown(rl.KeyDown) {
-			cameraOffset.Y -= 1000 * delta
+
+		if !routeNameBox.Focused {
+			if rl.IsKeyDown(rl.KeyA) || rl.IsKeyDown(rl.KeyLeft) {
+				cameraOffset.X += 1000 * delta
+			}
+			if rl.IsKeyDown(rl.KeyD) || rl.IsKeyDown(rl.KeyRight) {
+				cameraOffset.X -= 1000 * delta
+			}
+			if rl.IsKeyDown(rl.KeyW) || rl.IsKeyDown(rl.KeyUp) {
+				cameraOffset.Y += 1000 * delta
+			}
+			if rl.IsKeyDown(rl.KeyS) || rl.IsKeyDown(rl.KeyDown) {
+				cameraOffset.Y -= 1000 * delta
+			}
 		}
 
 		wheel := rl.GetMouseWheelMove()
@@ -197,11 +259,24 @@ func update(delta float32) {
 			}
 		}
 
-		if rl.IsKeyPressed(rl.KeyG) {
+		if rl.IsKeyPressed(rl.KeyG) && !routeNameBox.Focused {
 			showGrid = !showGrid
 		}
+		if rl.IsKeyPressed(rl.KeyO) && !routeNameBox.Focused {
+			currentOverlay = (currentOverlay + 1) % numOverlayModes
+		}
+		if rl.IsKeyPressed(rl.KeyL) && !routeNameBox.Focused {
+			showRoutesPanel = !showRoutesPanel
+		}
+		if rl.IsKeyPressed(rl.KeyF) && !routeNameBox.Focused && currentInfraType == Road {
+			isOneWay = !isOneWay
+		}
+		if rl.IsKeyPressed(rl.KeyT) && !routeNameBox.Focused && currentInfraType == Road {
+			useTunnels = !useTunnels
+		}
 
-		if mousePos.Y > UI_HEIGHT {
+		overInspector := isInspecting && currentBuildMode == BuildingMode && rl.CheckCollisionPointRec(mousePos, buildingInspectorRect)
+		if mousePos.Y > UI_HEIGHT && !overInspector && !(showRoutesPanel && rl.CheckCollisionPointRec(mousePos, routesPanelRect())) {
 			worldPos := screenToWorld(mousePos)
 			snappedPos := snapToGrid(worldPos)
 
@@ -215,12 +290,24 @@ func update(delta float32) {
 						client.SendBuilding(snappedPos.X, snappedPos.Y, currentBuildingType)
 					}
 				case BusRouteMode:
-					currentRouteNodes = append(currentRouteNodes, snappedPos)
-					isCreatingBusRoute = true
+					switch currentRouteTool {
+					case StopTool:
+						if client.Connected {
+							client.SendBusStop(snappedPos.X, snappedPos.Y)
+						}
+					case EditRouteTool:
+						startRouteEdit(worldPos, snappedPos)
+					default:
+						currentRouteNodes = append(currentRouteNodes, snappedPos)
+						isCreatingBusRoute = true
+					}
 				case DeleteMode:
 					if client.Connected {
 						client.SendDelete(snappedPos.X, snappedPos.Y)
 					}
+				case ZoningMode:
+					isZoning = true
+					zoneStart = snappedPos
 				}
 			}
 
@@ -229,11 +316,41 @@ func update(delta float32) {
 				buildEnd := snappedPos
 
 				if buildStart.X != buildEnd.X || buildStart.Y != buildEnd.Y {
+					class, oneWay, crossing := currentRoadClass, isOneWay, Bridge
+					if useTunnels {
+						crossing = Tunnel
+					}
+					if currentInfraType != Road {
+						class, oneWay, crossing = Street, false, NoCrossing
+					}
 					if client.Connected {
-						client.SendInfrastructure(buildStart.X, buildStart.Y, buildEnd.X, buildEnd.Y, currentInfraType)
+						client.SendInfrastructure(buildStart.X, buildStart.Y, buildEnd.X, buildEnd.Y, currentInfraType, class, oneWay, crossing)
 					}
 				}
 			}
+
+			if rl.IsMouseButtonReleased(rl.MouseLeftButton) && draggedRouteNode != -1 {
+				if nodes, ok := selectedRouteNodes(); ok && currentBuildMode == BusRouteMode && draggedRouteNode < len(nodes) {
+					nodes[draggedRouteNode] = snappedPos
+					client.SendRouteEdit(selectedRoute, nodes)
+				}
+				draggedRouteNode = -1
+			}
+
+			if rl.IsMouseButtonPressed(rl.MouseRightButton) && currentBuildMode == BusRouteMode && currentRouteTool == EditRouteTool {
+				removeRouteNode(snappedPos)
+			}
+
+			if rl.IsMouseButtonPressed(rl.MouseRightButton) && currentBuildMode == BuildingMode {
+				inspectedBuilding, isInspecting = snappedPos, true
+			}
+
+			if rl.IsMouseButtonReleased(rl.MouseLeftButton) && isZoning && currentBuildMode == ZoningMode {
+				isZoning = false
+				if client.Connected {
+					client.SendZone(zoneStart.X, zoneStart.Y, snappedPos.X, snappedPos.Y, currentZoneType)
+				}
+			}
 		}
 
 		sendTimer += delta
@@ -259,12 +376,265 @@ func update(delta float32) {
 	}
 }
 
+// selectedRouteNodes returns a copy of the nodes of the selected bus route.
+func selectedRouteNodes() ([]rl.Vector2, bool) {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+
+	if selectedRoute < 0 || selectedRoute >= len(client.BusRoutes) {
+		return nil, false
+	}
+	return append([]rl.Vector2{}, client.BusRoutes[selectedRoute].Nodes...), true
+}
+
+func selectedRouteIsLoop() bool {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+
+	return selectedRoute >= 0 && selectedRoute < len(client.BusRoutes) && client.BusRoutes[selectedRoute].Loop
+}
+
+// startRouteEdit starts dragging the node of the selected route under the
+// cursor, or inserts a new node when a segment was clicked.
+func startRouteEdit(worldPos, snappedPos rl.Vector2) {
+	nodes, ok := selectedRouteNodes()
+	if !ok {
+		return
+	}
+	for i, node := range nodes {
+		if node == snappedPos {
+			draggedRouteNode = i
+			return
+		}
+	}
+
+	segments := len(nodes) - 1
+	if selectedRouteIsLoop() {
+		segments = len(nodes)
+	}
+	for j := 0; j < segments; j++ {
+		if pointSegmentDistance(worldPos, nodes[j], nodes[(j+1)%len(nodes)]) <= ROAD_SNAP_DISTANCE {
+			nodes = append(nodes[:j+1], append([]rl.Vector2{snappedPos}, nodes[j+1:]...)...)
+			client.SendRouteEdit(selectedRoute, nodes)
+			return
+		}
+	}
+}
+
+func removeRouteNode(snappedPos rl.Vector2) {
+	nodes, ok := selectedRouteNodes()
+	if !ok {
+		return
+	}
+	for i, node := range nodes {
+		if node == snappedPos {
+			nodes = append(nodes[:i], nodes[i+1:]...)
+			client.SendRouteEdit(selectedRoute, nodes)
+			return
+		}
+	}
+}
+
+const routesPanelRowHeight = 22
+
+func routesPanelRect() rl.Rectangle {
+	client.mutex.Lock()
+	rows := len(client.BusRoutes) + 1
+	client.mutex.Unlock()
+	return rl.NewRectangle(float32(rl.GetScreenWidth()-600), UI_HEIGHT+10, 590, float32(rows*routesPanelRowHeight+10))
+}
+
+// focusRoute centers the camera on the middle of a route.
+func focusRoute(route BusRoute) {
+	if len(route.Nodes) == 0 {
+		return
+	}
+	var center rl.Vector2
+	for _, node := range route.Nodes {
+		center = rl.Vector2Add(center, node)
+	}
+	center = rl.Vector2Scale(center, 1/float32(len(route.Nodes)))
+	cameraOffset = rl.NewVector2(
+		float32(rl.GetScreenWidth())/2/zoom-center.X,
+		float32(rl.GetScreenHeight()+UI_HEIGHT)/2/zoom-center.Y,
+	)
+}
+
+// drawRoutesPanel lists every route with its statistics. Clicking a name
+// focuses the camera on the route, the button hides or shows its line.
+func drawRoutesPanel() {
+	panel := routesPanelRect()
+	rl.DrawRectangleRec(panel, rl.Fade(rl.RayWhite, 0.9))
+	rl.DrawRectangleLinesEx(panel, 1, rl.Black)
+
+	x, y := panel.X+5, panel.Y+5
+	columns := []float32{0, 150, 250, 310, 360, 410, 480, 540}
+	headers := []string{"Line", "Owner", "Length", "Buses", "Trips", "Revenue", "Cost"}
+	for i, header := range headers {
+		rl.DrawText(header, int32(x+columns[i]), int32(y+4), 10, rl.DarkGray)
+	}
+
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	for i, route := range client.BusRoutes {
+		y += routesPanelRowHeight
+		rl.DrawRectangle(int32(x), int32(y+4), 12, 12, getRouteColor(route))
+		if gui.Button(rl.NewRectangle(x+16, y, columns[1]-20, 20), route.Name) {
+			selectedRoute = i
+			focusRoute(route)
+		}
+		values := []string{
+			route.Owner,
+			fmt.Sprintf("%.0f", route.Length),
+			fmt.Sprintf("%d", route.Vehicles),
+			fmt.Sprintf("%d", route.Trips),
+			fmt.Sprintf("$%.0f", route.Revenue),
+			fmt.Sprintf("$%.0f", route.OpCost),
+		}
+		for j, value := range values {
+			rl.DrawText(value, int32(x+columns[j+1]), int32(y+4), 10, rl.Black)
+		}
+		visibleText := "Hide"
+		if hiddenRoutes[route.ID] {
+			visibleText = "Show"
+		}
+		if gui.Button(rl.NewRectangle(panel.X+panel.Width-45, y, 40, 20), visibleText) {
+			hiddenRoutes[route.ID] = !hiddenRoutes[route.ID]
+		}
+	}
+}
+
+// drawBuildingInspector shows the state of the inspected building and lets the
+// player upgrade it to the next level.
+func drawBuildingInspector() {
+	client.mutex.Lock()
+	index := -1
+	for i, b := range client.Buildings {
+		if b.Position == inspectedBuilding {
+			index = i
+			break
+		}
+	}
+	if index == -1 {
+		client.mutex.Unlock()
+		isInspecting = false
+		return
+	}
+	building := client.Buildings[index]
+	client.mutex.Unlock()
+
+	panel := buildingInspectorRect
+	rl.DrawRectangleRec(panel, rl.Fade(rl.RayWhite, 0.9))
+	rl.DrawRectangleLinesEx(panel, 1, rl.Black)
+	x, y := panel.X+5, panel.Y+5
+	rl.DrawText(getBuildingName(building.Type), int32(x), int32(y+4), 10, rl.Black)
+	if gui.Button(rl.NewRectangle(panel.X+panel.Width-25, y, 20, 20), "X") {
+		isInspecting = false
+	}
+
+	status := "OK"
+	if building.Abandoned {
+		status = fmt.Sprintf("Abandoned (%.0f%% decayed)", building.Decay*100)
+	}
+	rows := []string{
+		fmt.Sprintf("Level: %d / %d", building.Level, MAX_BUILDING_LEVEL),
+		fmt.Sprintf("Occupants: %d / %d", building.Occupants, building.Capacity),
+		"Road: " + yesNo(building.Connected),
+		"Water: " + yesNo(building.Watered),
+		"Power: " + yesNo(building.Powered),
+		"Status: " + status,
+	}
+	if building.Type == Residential {
+		rows = append(rows, fmt.Sprintf("Happiness: %.0f%%", building.Happiness*100))
+	} else if isWorkplace(building.Type) {
+		rows = append(rows, fmt.Sprintf("Goods supply: %.0f%%", building.Supply*100))
+	}
+	for _, row := range rows {
+		y += 18
+		rl.DrawText(row, int32(x), int32(y+4), 10, rl.DarkGray)
+	}
+
+	if isZoneType(building.Type) && !building.Abandoned && building.Level < MAX_BUILDING_LEVEL {
+		upgradeText := fmt.Sprintf("Upgrade ($%.0f)", getUpgradeCost(building.Type, building.Level))
+		if gui.Button(rl.NewRectangle(x, panel.Y+panel.Height-30, panel.Width-10, 25), upgradeText) && client.Connected {
+			client.SendUpgrade(building.Position.X, building.Position.Y)
+		}
+	}
+}
+
+func yesNo(value bool) string {
+	if value {
+		return "yes"
+	}
+	return "no"
+}
+
+// isMetroStation reports whether a stop only serves metro lines, so it is
+// drawn as an underground station. The client mutex must be held.
+func isMetroStation(pos rl.Vector2) bool {
+	metro := false
+	for _, route := range client.BusRoutes {
+		for _, node := range route.Nodes {
+			if node != pos {
+				continue
+			}
+			if route.Mode != MetroTransit {
+				return false
+			}
+			metro = true
+		}
+	}
+	return metro
+}
+
+func drawDashedLine(start, end rl.Vector2, thickness, dash float32, color rl.Color) {
+	length := rl.Vector2Distance(start, end)
+	if length == 0 {
+		return
+	}
+	for d := float32(0); d < length; d += 2 * dash {
+		from := rl.Vector2Lerp(start, end, d/length)
+		to := rl.Vector2Lerp(start, end, min(d+dash, length)/length)
+		rl.DrawLineEx(from, to, thickness, color)
+	}
+}
+
+func getTransitName(mode TransitMode) string {
+	switch mode {
+	case TramTransit:
+		return "Tram"
+	case MetroTransit:
+		return "Metro"
+	default:
+		return "Bus"
+	}
+}
+
+func getTransitVehicleName(mode TransitMode) string {
+	switch mode {
+	case TramTransit:
+		return "trams"
+	case MetroTransit:
+		return "trains"
+	default:
+		return "buses"
+	}
+}
+
+func getRouteColor(route BusRoute) rl.Color {
+	return routeColors[route.Color%NUM_ROUTE_COLORS]
+}
+
 func getInfrastructureColor(infraType InfrastructureType) rl.Color {
 	switch infraType {
 	case Road:
 		return rl.Black
 	case Water:
 		return rl.Blue
+	case WaterPipe:
+		return rl.SkyBlue
+	case PowerLine:
+		return rl.Gold
 	default:
 		return rl.Green
 	}
@@ -276,22 +646,67 @@ func getInfrastructureName(infraType InfrastructureType) string {
 		return "Road"
 	case Water:
 		return "Water"
+	case WaterPipe:
+		return "Water Pipe"
+	case PowerLine:
+		return "Power Line"
 	default:
 		return "Unknown"
 	}
 }
 
-func getInfrastructureThickness(infraType InfrastructureType) float32 {
+func getInfrastructureThickness(infraType InfrastructureType, class RoadClass) float32 {
 	switch infraType {
 	case Road:
-		return 4
+		switch class {
+		case Avenue:
+			return 6
+		case Highway:
+			return 9
+		default:
+			return 4
+		}
 	case Water:
 		return 8
+	case WaterPipe:
+		return 3
+	case PowerLine:
+		return 2
 	default:
 		return 6
 	}
 }
 
+// drawOneWayArrows draws small arrow heads along a road pointing from start
+// to end.
+func drawOneWayArrows(start, end rl.Vector2, color rl.Color) {
+	length := rl.Vector2Distance(start, end)
+	if length == 0 {
+		return
+	}
+	direction := rl.Vector2Scale(rl.Vector2Subtract(end, start), 1/length)
+	normal := rl.NewVector2(-direction.Y, direction.X)
+	size := 4 * zoom
+	spacing := GRID_SIZE * 2 * zoom
+	for d := spacing / 2; d < length; d += spacing {
+		tip := rl.Vector2Add(start, rl.Vector2Scale(direction, d))
+		back := rl.Vector2Subtract(tip, rl.Vector2Scale(direction, size))
+		rl.DrawLineEx(tip, rl.Vector2Add(back, rl.Vector2Scale(normal, size)), zoom, color)
+		rl.DrawLineEx(tip, rl.Vector2Subtract(back, rl.Vector2Scale(normal, size)), zoom, color)
+	}
+}
+
+func getRoadClassName(class RoadClass) string {
+	switch class {
+	case Avenue:
+		return "Avenue"
+	case Highway:
+		return "Highway"
+	default:
+		return "Street"
+	}
+}
+
 func getBuildingColor(buildingType BuildingType) rl.Color {
 	switch buildingType {
 	case Residential:
@@ -300,11 +715,41 @@ func getBuildingColor(buildingType BuildingType) rl.Color {
 		return rl.Blue
 	case Industrial:
 		return rl.Red
+	case WaterPump:
+		return rl.SkyBlue
+	case PowerPlant:
+		return rl.Gold
+	case PoliceStation:
+		return rl.DarkBlue
+	case FireStation:
+		return rl.Orange
+	case Clinic:
+		return rl.Pink
+	case School:
+		return rl.Violet
+	case Park:
+		return rl.Lime
+	case Plaza:
+		return rl.LightGray
+	case Tree:
+		return rl.DarkGreen
 	default:
 		return rl.Gray
 	}
 }
 
+func getZoneColor(zoneType BuildingType) rl.Color {
+	color := getBuildingColor(zoneType)
+	return rl.NewColor(color.R, color.G, color.B, 60)
+}
+
+func getZoneName(zoneType BuildingType) string {
+	if zoneType == NoZone {
+		return "Clear Zone"
+	}
+	return getBuildingName(zoneType)
+}
+
 func getBuildingName(buildingType BuildingType) string {
 	switch buildingType {
 	case Residential:
@@ -313,11 +758,187 @@ func getBuildingName(buildingType BuildingType) string {
 		return "Commercial"
 	case Industrial:
 		return "Industrial"
+	case WaterPump:
+		return "Water Pump"
+	case PowerPlant:
+		return "Power Plant"
+	case PoliceStation:
+		return "Police Station"
+	case FireStation:
+		return "Fire Station"
+	case Clinic:
+		return "Clinic"
+	case School:
+		return "School"
+	case Park:
+		return "Park"
+	case Plaza:
+		return "Plaza"
+	case Tree:
+		return "Tree"
+	default:
+		return "Unknown"
+	}
+}
+
+// getBuildingShortName returns a name that fits on a small button.
+func getBuildingShortName(buildingType BuildingType) string {
+	switch buildingType {
+	case PoliceStation:
+		return "Police"
+	case FireStation:
+		return "Fire"
+	default:
+		return getBuildingName(buildingType)
+	}
+}
+
+func getOverlayName(overlay OverlayMode) string {
+	switch overlay {
+	case WaterOverlay:
+		return "Water Supply"
+	case PowerOverlay:
+		return "Power Grid"
+	case TrafficOverlay:
+		return "Traffic (green: free, red: congested)"
+	case GoodsOverlay:
+		return "Goods Supply"
+	case PollutionOverlay:
+		return "Pollution"
+	case NoiseOverlay:
+		return "Noise"
+	case LandValueOverlay:
+		return "Land Value"
+	case PoliceOverlay:
+		return "Police Coverage (red: uncovered)"
+	case FireOverlay:
+		return "Fire Coverage (red: uncovered)"
+	case HealthOverlay:
+		return "Health Coverage (red: uncovered)"
+	case EducationOverlay:
+		return "Education Coverage (red: uncovered)"
+	default:
+		return "None"
+	}
+}
+
+func getCommuteModeName(mode CommuteMode) string {
+	switch mode {
+	case WalkCommute:
+		return "Walking"
+	case DriveCommute:
+		return "Driving"
+	case TransitCommute:
+		return "Transit"
 	default:
 		return "Unknown"
 	}
 }
 
+// getOverlayHeatmap returns the heatmap shown by an overlay, the color of its
+// highest values and the value at which that color is fully opaque.
+func getOverlayHeatmap(overlay OverlayMode) (HeatmapKind, rl.Color, float32, bool) {
+	switch overlay {
+	case PollutionOverlay:
+		return PollutionHeatmap, rl.Brown, POLLUTION_SCALE, true
+	case NoiseOverlay:
+		return NoiseHeatmap, rl.Purple, POLLUTION_SCALE, true
+	case LandValueOverlay:
+		return LandValueHeatmap, rl.DarkGreen, MAX_LAND_VALUE, true
+	case PoliceOverlay:
+		return PoliceHeatmap, rl.DarkBlue, MAX_COVERAGE, true
+	case FireOverlay:
+		return FireHeatmap, rl.Orange, MAX_COVERAGE, true
+	case HealthOverlay:
+		return HealthHeatmap, rl.Pink, MAX_COVERAGE, true
+	case EducationOverlay:
+		return EducationHeatmap, rl.Violet, MAX_COVERAGE, true
+	default:
+		return 0, rl.Blank, 0, false
+	}
+}
+
+// drawHeatmap fills every grid cell of a heatmap with the color, more opaque
+// for higher values.
+func drawHeatmap(heatmap map[int]float32, color rl.Color, scale float32) {
+	size := GRID_SIZE * zoom
+	for cell, value := range heatmap {
+		pos := worldToScreen(rl.NewVector2(float32(cell%GRID_CELLS)*GRID_SIZE, float32(cell/GRID_CELLS)*GRID_SIZE))
+		alpha := min(1, value/scale) * 0.7
+		rl.DrawRectangleRec(rl.NewRectangle(pos.X, pos.Y, size, size), rl.Fade(color, alpha))
+	}
+}
+
+func getTrafficColor(congestion float32) rl.Color {
+	switch {
+	case congestion < 0.5:
+		return rl.Lime
+	case congestion < 0.8:
+		return rl.Yellow
+	case congestion < 1.0:
+		return rl.Orange
+	default:
+		return rl.Red
+	}
+}
+
+// drawDecoration draws a park as a lawn with a few trees, a plaza as a paved
+// square and a tree as a round crown.
+func drawDecoration(building Building) {
+	screenPos := worldToScreen(building.Position)
+	size := GRID_SIZE * zoom
+	rect := rl.NewRectangle(screenPos.X-size/2, screenPos.Y-size/2, size, size)
+	switch building.Type {
+	case Park:
+		rl.DrawRectangleRec(rect, getBuildingColor(Park))
+		rl.DrawCircleV(rl.NewVector2(screenPos.X-size/4, screenPos.Y-size/4), size/6, rl.DarkGreen)
+		rl.DrawCircleV(rl.NewVector2(screenPos.X+size/4, screenPos.Y), size/6, rl.DarkGreen)
+		rl.DrawCircleV(rl.NewVector2(screenPos.X-size/6, screenPos.Y+size/4), size/6, rl.DarkGreen)
+	case Plaza:
+		rl.DrawRectangleRec(rect, getBuildingColor(Plaza))
+		for k := float32(1); k < 4; k++ {
+			rl.DrawLineV(rl.NewVector2(rect.X+rect.Width*k/4, rect.Y), rl.NewVector2(rect.X+rect.Width*k/4, rect.Y+rect.Height), rl.Gray)
+			rl.DrawLineV(rl.NewVector2(rect.X, rect.Y+rect.Height*k/4), rl.NewVector2(rect.X+rect.Width, rect.Y+rect.Height*k/4), rl.Gray)
+		}
+		rl.DrawCircleV(screenPos, size/8, rl.SkyBlue)
+	case Tree:
+		rl.DrawCircleV(screenPos, size/3, getBuildingColor(Tree))
+		rl.DrawCircleV(screenPos, size/8, rl.Brown)
+	}
+}
+
+// drawWarningIcon draws a small warning triangle centered on pos.
+func drawWarningIcon(pos rl.Vector2) {
+	size := 12 * zoom
+	top := rl.NewVector2(pos.X, pos.Y-size/2)
+	left := rl.NewVector2(pos.X-size/2, pos.Y+size/2)
+	right := rl.NewVector2(pos.X+size/2, pos.Y+size/2)
+	rl.DrawTriangle(top, left, right, rl.Yellow)
+	rl.DrawTriangleLines(top, left, right, rl.Black)
+	fontSize := int32(10 * zoom)
+	rl.DrawText("!", int32(pos.X)-rl.MeasureText("!", fontSize)/2, int32(pos.Y-size/4), fontSize, rl.Black)
+}
+
+// drawDemandBars draws the residential, commercial and industrial demand as
+// bars growing up (demand) or down (oversupply) from a center line.
+func drawDemandBars(x, y float32) {
+	const barWidth, barHeight = 20, 40
+	labels := []string{"R", "C", "I"}
+	for i, demand := range client.Demand {
+		barX := x + float32(i)*(barWidth+10)
+		centerY := y + barHeight/2
+		rl.DrawRectangleLinesEx(rl.NewRectangle(barX, y, barWidth, barHeight), 1, rl.Gray)
+		height := demand * barHeight / 2
+		if height > 0 {
+			rl.DrawRectangleRec(rl.NewRectangle(barX, centerY-height, barWidth, height), getBuildingColor(BuildingType(i)))
+		} else {
+			rl.DrawRectangleRec(rl.NewRectangle(barX, centerY, barWidth, -height), rl.Gray)
+		}
+		rl.DrawLineV(rl.NewVector2(barX, centerY), rl.NewVector2(barX+barWidth, centerY), rl.Black)
+		rl.DrawText(labels[i], int32(barX)+barWidth/2-rl.MeasureText(labels[i], 10)/2, int32(y+barHeight+2), 10, rl.Black)
+	}
+}
+
 func drawGrid() {
 	if !showGrid {
 		return
@@ -373,39 +994,190 @@ func draw() {
 		portBox.Draw()
 	case InGame:
 		drawGrid()
+		mapOrigin := worldToScreen(rl.NewVector2(0, 0))
+		rl.DrawRectangleLinesEx(rl.NewRectangle(mapOrigin.X, mapOrigin.Y, MAP_SIZE*zoom, MAP_SIZE*zoom), 2, rl.DarkGreen)
 
 		if client.Connected {
 			client.mutex.Lock()
 
+			for _, zone := range client.Zones {
+				screenPos := worldToScreen(zone.Position)
+				size := GRID_SIZE * zoom
+				rl.DrawRectangleRec(rl.NewRectangle(screenPos.X-size/2, screenPos.Y-size/2, size, size), getZoneColor(zone.Type))
+			}
+
+			showPipes := currentOverlay == WaterOverlay || (currentBuildMode == InfrastructureMode && currentInfraType == WaterPipe)
 			for _, line := range client.CityLines {
+				if line.Type == WaterPipe && !showPipes {
+					continue
+				}
 				color := getInfrastructureColor(line.Type)
-				thickness := getInfrastructureThickness(line.Type)
+				if currentOverlay == TrafficOverlay && line.Type == Road {
+					color = getTrafficColor(line.Congestion)
+				}
+				thickness := getInfrastructureThickness(line.Type, line.Class)
 				screenStart := worldToScreen(line.Start)
 				screenEnd := worldToScreen(line.End)
-				rl.DrawLineEx(screenStart, screenEnd, thickness*zoom, color)
+				switch line.Crossing {
+				case Bridge:
+					rl.DrawLineEx(screenStart, screenEnd, (thickness+6)*zoom, rl.Brown)
+					rl.DrawLineEx(screenStart, screenEnd, thickness*zoom, color)
+				case Tunnel:
+					drawDashedLine(screenStart, screenEnd, thickness*zoom, 6*zoom, rl.Fade(color, 0.5))
+					portal := (thickness + 4) * zoom
+					rl.DrawRectangleV(rl.NewVector2(screenStart.X-portal/2, screenStart.Y-portal/2), rl.NewVector2(portal, portal), rl.DarkGray)
+					rl.DrawRectangleV(rl.NewVector2(screenEnd.X-portal/2, screenEnd.Y-portal/2), rl.NewVector2(portal, portal), rl.DarkGray)
+				default:
+					rl.DrawLineEx(screenStart, screenEnd, thickness*zoom, color)
+				}
+				if line.Type == Road && line.Class == Highway {
+					rl.DrawLineEx(screenStart, screenEnd, zoom, rl.Yellow)
+				}
+				if line.OneWay {
+					drawOneWayArrows(screenStart, screenEnd, rl.White)
+				}
 				rl.DrawCircleV(screenStart, 4*zoom, color)
 				rl.DrawCircleV(screenEnd, 4*zoom, color)
 			}
 
 			for _, building := range client.Buildings {
-				color := getBuildingColor(building.Type)
+				if isDecorationType(building.Type) {
+					drawDecoration(building)
+					continue
+				}
+				color := rl.ColorBrightness(getBuildingColor(building.Type), -0.15*float32(building.Level-1))
 				screenPos := worldToScreen(building.Position)
-				size := GRID_SIZE * zoom * 0.8
+				size := GRID_SIZE * zoom * (0.7 + 0.1*float32(building.Level))
+				if building.Abandoned {
+					color = rl.Fade(rl.ColorBrightness(rl.Gray, -0.3), 1-0.5*building.Decay)
+					size *= 1 - 0.3*building.Decay
+				}
 				rect := rl.NewRectangle(screenPos.X-size/2, screenPos.Y-size/2, size, size)
 				rl.DrawRectangleRec(rect, color)
 				rl.DrawRectangleLinesEx(rect, 2, rl.Black)
+				if building.Abandoned {
+					rl.DrawLineEx(rl.NewVector2(rect.X, rect.Y), rl.NewVector2(rect.X+rect.Width, rect.Y+rect.Height), 2, rl.Black)
+					rl.DrawLineEx(rl.NewVector2(rect.X+rect.Width, rect.Y), rl.NewVector2(rect.X, rect.Y+rect.Height), 2, rl.Black)
+				}
+				if isInspecting && currentBuildMode == BuildingMode && building.Position == inspectedBuilding {
+					rl.DrawRectangleLinesEx(rect, 3, rl.Yellow)
+				}
+				if !building.Connected {
+					drawWarningIcon(rl.NewVector2(rect.X+rect.Width, rect.Y))
+				}
+			}
+
+			if kind, color, scale, ok := getOverlayHeatmap(currentOverlay); ok {
+				drawHeatmap(client.Heatmaps[kind], color, scale)
+				if kind >= PoliceHeatmap {
+					for _, building := range client.Buildings {
+						cell, ok := cellIndex(building.Position.X, building.Position.Y)
+						if ok && isZoneType(building.Type) && client.Heatmaps[kind][cell] < 1 {
+							rl.DrawCircleV(worldToScreen(building.Position), GRID_SIZE*zoom*0.6, rl.NewColor(230, 41, 55, 120))
+						}
+					}
+				}
+			}
+
+			if currentOverlay == GoodsOverlay {
+				for _, building := range client.Buildings {
+					if !isWorkplace(building.Type) {
+						continue
+					}
+					color := rl.NewColor(230, 41, 55, 120)
+					if building.Supply >= 0.5 {
+						color = rl.NewColor(0, 228, 48, uint8(60+building.Supply*100))
+					}
+					rl.DrawCircleV(worldToScreen(building.Position), GRID_SIZE*zoom*0.6, color)
+				}
 			}
 
-			if currentBuildMode == BusRouteMode {
-				for _, route := range client.BusRoutes {
-					for j := 0; j < len(route.Nodes)-1; j++ {
-						screenStart := worldToScreen(route.Nodes[j])
-						screenEnd := worldToScreen(route.Nodes[j+1])
-						rl.DrawLineEx(screenStart, screenEnd, 2*zoom, rl.Orange)
+			if currentOverlay == WaterOverlay || currentOverlay == PowerOverlay {
+				for _, building := range client.Buildings {
+					if !isZoneType(building.Type) {
+						continue
 					}
-					for _, node := range route.Nodes {
+					supplied, suppliedColor := building.Watered, rl.NewColor(0, 121, 241, 120)
+					if currentOverlay == PowerOverlay {
+						supplied, suppliedColor = building.Powered, rl.NewColor(253, 249, 0, 140)
+					}
+					color := rl.NewColor(230, 41, 55, 120)
+					if supplied {
+						color = suppliedColor
+					}
+					rl.DrawCircleV(worldToScreen(building.Position), GRID_SIZE*zoom*0.6, color)
+				}
+			}
+
+			if currentBuildMode == BusRouteMode || showRoutesPanel {
+				for i, route := range client.BusRoutes {
+					if hiddenRoutes[route.ID] {
+						continue
+					}
+					thickness := 2 * zoom
+					if i == selectedRoute {
+						thickness = 4 * zoom
+					}
+					color := getRouteColor(route)
+					nodes := route.Nodes
+					if i == selectedRoute && draggedRouteNode >= 0 && draggedRouteNode < len(nodes) {
+						nodes = append([]rl.Vector2{}, nodes...)
+						nodes[draggedRouteNode] = snapToGrid(screenToWorld(rl.GetMousePosition()))
+					}
+					segments := len(nodes) - 1
+					if route.Loop {
+						segments = len(nodes)
+					}
+					for j := 0; j < segments; j++ {
+						screenStart := worldToScreen(nodes[j])
+						screenEnd := worldToScreen(nodes[(j+1)%len(nodes)])
+						switch route.Mode {
+						case TramTransit:
+							rl.DrawLineEx(screenStart, screenEnd, thickness*1.5, color)
+							rl.DrawLineEx(screenStart, screenEnd, zoom, rl.DarkGray)
+						case MetroTransit:
+							drawDashedLine(screenStart, screenEnd, thickness, 10*zoom, color)
+						default:
+							rl.DrawLineEx(screenStart, screenEnd, thickness, color)
+						}
+					}
+					for _, node := range nodes {
 						screenNode := worldToScreen(node)
-						rl.DrawCircleV(screenNode, 6*zoom, rl.Orange)
+						rl.DrawCircleV(screenNode, 6*zoom, color)
+					}
+					labelPos := worldToScreen(route.Nodes[0])
+					rl.DrawText(fmt.Sprintf("%s (%s): %d riders", route.Name, getTransitName(route.Mode), route.Riders), int32(labelPos.X+8*zoom), int32(labelPos.Y-20*zoom), 10, rl.DarkBrown)
+				}
+			}
+
+			for _, stop := range client.BusStops {
+				screenPos := worldToScreen(stop.Position)
+				size := 10 * zoom
+				if isMetroStation(stop.Position) {
+					rl.DrawCircleV(screenPos, size*0.7, rl.DarkBlue)
+					rl.DrawText("M", int32(screenPos.X-3), int32(screenPos.Y-5), 10, rl.White)
+				} else {
+					rect := rl.NewRectangle(screenPos.X-size/2, screenPos.Y-size/2, size, size)
+					rl.DrawRectangleRec(rect, rl.White)
+					rl.DrawRectangleLinesEx(rect, 2*zoom, rl.DarkBlue)
+				}
+				if currentBuildMode == BusRouteMode {
+					rl.DrawText(fmt.Sprintf("%d", stop.Waiting), int32(screenPos.X+size), int32(screenPos.Y), 10, rl.DarkBlue)
+				}
+			}
+
+			for _, truck := range client.Trucks {
+				screenPos := worldToScreen(truck)
+				size := 6 * zoom
+				rl.DrawRectangleRec(rl.NewRectangle(screenPos.X-size/2, screenPos.Y-size/2, size, size), rl.Brown)
+			}
+
+			for _, line := range client.CityLines {
+				for _, end := range []rl.Vector2{line.Start, line.End} {
+					if line.Type == Road && isAtMapEdge(end) {
+						screenPos := worldToScreen(end)
+						rl.DrawCircleV(screenPos, 8*zoom, rl.DarkGreen)
+						rl.DrawText("Export", int32(screenPos.X+10*zoom), int32(screenPos.Y-5), 10, rl.DarkGreen)
 					}
 				}
 			}
@@ -413,9 +1185,21 @@ func draw() {
 			for _, bus := range client.Buses {
 				busScreenPos := worldToScreen(bus.Position)
 				busSize := 8 * zoom
+				busColor := rl.Orange
+				if bus.RouteID >= 0 && bus.RouteID < len(client.BusRoutes) {
+					route := client.BusRoutes[bus.RouteID]
+					busColor = getRouteColor(route)
+					switch route.Mode {
+					case TramTransit:
+						busSize = 12 * zoom
+					case MetroTransit:
+						busSize = 14 * zoom
+						busColor = rl.Fade(busColor, 0.5)
+					}
+				}
 				rect := rl.NewRectangle(busScreenPos.X-busSize/2, busScreenPos.Y-busSize/2,
 					busSize, busSize)
-				rl.DrawRectangleRec(rect, rl.Orange)
+				rl.DrawRectangleRec(rect, busColor)
 				rl.DrawRectangleLinesEx(rect, zoom, rl.Black)
 			}
 			client.mutex.Unlock()
@@ -427,12 +1211,33 @@ func draw() {
 				worldPos := screenToWorld(mousePos)
 				snappedEnd := snapToGrid(worldPos)
 				color := getInfrastructureColor(currentInfraType)
-				thickness := getInfrastructureThickness(currentInfraType)
+				thickness := getInfrastructureThickness(currentInfraType, currentRoadClass)
 
 				screenStart := worldToScreen(buildStart)
 				screenEnd := worldToScreen(snappedEnd)
 
 				rl.DrawLineEx(screenStart, screenEnd, thickness*zoom, rl.NewColor(color.R, color.G, color.B, 128))
+				if currentInfraType == Road && isOneWay {
+					drawOneWayArrows(screenStart, screenEnd, rl.White)
+				}
+			}
+		}
+
+		if isZoning && currentBuildMode == ZoningMode {
+			mousePos := rl.GetMousePosition()
+			if mousePos.Y > UI_HEIGHT {
+				snappedEnd := snapToGrid(screenToWorld(mousePos))
+				screenStart := worldToScreen(rl.NewVector2(float32(math.Min(float64(zoneStart.X), float64(snappedEnd.X)))-GRID_SIZE/2,
+					float32(math.Min(float64(zoneStart.Y), float64(snappedEnd.Y)))-GRID_SIZE/2))
+				width := (float32(math.Abs(float64(snappedEnd.X-zoneStart.X))) + GRID_SIZE) * zoom
+				height := (float32(math.Abs(float64(snappedEnd.Y-zoneStart.Y))) + GRID_SIZE) * zoom
+				rect := rl.NewRectangle(screenStart.X, screenStart.Y, width, height)
+				color := getZoneColor(currentZoneType)
+				if currentZoneType == NoZone {
+					color = rl.NewColor(128, 128, 128, 60)
+				}
+				rl.DrawRectangleRec(rect, color)
+				rl.DrawRectangleLinesEx(rect, 1, rl.DarkGray)
 			}
 		}
 
@@ -485,6 +1290,9 @@ func draw() {
 		if gui.Button(rl.NewRectangle(350, 10, 80, 25), "Delete") {
 			currentBuildMode = DeleteMode
 		}
+		if gui.Button(rl.NewRectangle(440, 10, 80, 25), "Zones") {
+			currentBuildMode = ZoningMode
+		}
 
 		if currentBuildMode == InfrastructureMode {
 			if gui.Button(rl.NewRectangle(10, 40, 60, 25), "Road") {
@@ -493,8 +1301,32 @@ func draw() {
 			if gui.Button(rl.NewRectangle(80, 40, 70, 25), "River") {
 				currentInfraType = Water
 			}
+			if gui.Button(rl.NewRectangle(160, 40, 60, 25), "Pipe") {
+				currentInfraType = WaterPipe
+			}
+			if gui.Button(rl.NewRectangle(230, 40, 70, 25), "Power") {
+				currentInfraType = PowerLine
+			}
 			currentTypeName := getInfrastructureName(currentInfraType)
 			currentColor := getInfrastructureColor(currentInfraType)
+			if currentInfraType == Road {
+				currentTypeName = getRoadClassName(currentRoadClass)
+				for class := Street; class < numRoadClasses; class++ {
+					if gui.Button(rl.NewRectangle(250+float32(class)*90, 70, 80, 25), getRoadClassName(class)) {
+						currentRoadClass = class
+					}
+				}
+			}
+			if currentInfraType == Road {
+				if isOneWay {
+					currentTypeName += " (one-way)"
+				}
+				crossingName := "bridges"
+				if useTunnels {
+					crossingName = "tunnels"
+				}
+				gui.Label(rl.NewRectangle(10, UI_HEIGHT+25, 600, 20), "F: Toggle one-way, drag in the direction of travel. T: Cross rivers with "+crossingName+".")
+			}
 			gui.Label(rl.NewRectangle(36, 70, 200, 20), "Building: "+currentTypeName)
 			rl.DrawRectangle(10, 72, 16, 16, currentColor)
 		}
@@ -510,29 +1342,110 @@ func draw() {
 			if gui.Button(rl.NewRectangle(240, 40, 100, 25), "Industrial") {
 				currentBuildingType = Industrial
 			}
+			if gui.Button(rl.NewRectangle(350, 40, 80, 25), "Pump") {
+				currentBuildingType = WaterPump
+			}
+			if gui.Button(rl.NewRectangle(440, 40, 80, 25), "Plant") {
+				currentBuildingType = PowerPlant
+			}
+			for i, buildingType := range []BuildingType{PoliceStation, FireStation, Clinic, School, Park, Plaza, Tree} {
+				if gui.Button(rl.NewRectangle(250+float32(i)*65, 70, 60, 25), getBuildingShortName(buildingType)) {
+					currentBuildingType = buildingType
+				}
+			}
 			currentBuildingName := getBuildingName(currentBuildingType)
 			currentBuildingColor := getBuildingColor(currentBuildingType)
 			gui.Label(rl.NewRectangle(36, 70, 200, 20), "Building: "+currentBuildingName)
 			rl.DrawRectangleRec(rect, currentBuildingColor)
 			rl.DrawRectangleLinesEx(rect, 2, rl.Black)
+			gui.Label(rl.NewRectangle(10, UI_HEIGHT+25, 600, 20), "Right-click a building to inspect and upgrade it.")
+			if isInspecting {
+				drawBuildingInspector()
+			}
 		}
 
 		if currentBuildMode == BusRouteMode {
-			gui.Label(rl.NewRectangle(10, 40, 400, 20), "Click to place bus route nodes.")
+			if gui.Button(rl.NewRectangle(10, 40, 110, 25), "New Route") {
+				currentRouteTool = NewRouteTool
+			}
+			if gui.Button(rl.NewRectangle(130, 40, 70, 25), "Stops") {
+				currentRouteTool = StopTool
+			}
+			if gui.Button(rl.NewRectangle(210, 40, 70, 25), "Edit") {
+				currentRouteTool = EditRouteTool
+			}
+			switch currentRouteTool {
+			case NewRouteTool:
+				if gui.Button(rl.NewRectangle(290, 40, 90, 25), getTransitName(currentTransitMode)) && !isCreatingBusRoute {
+					currentTransitMode = (currentTransitMode + 1) % numTransitModes
+				}
+				gui.Label(rl.NewRectangle(390, 40, 160, 20), "Click to place nodes.")
+			case StopTool:
+				gui.Label(rl.NewRectangle(290, 40, 260, 20), "Click nodes to toggle stops.")
+			case EditRouteTool:
+				gui.Label(rl.NewRectangle(10, UI_HEIGHT+25, 700, 20), "Drag nodes to move them, click a segment to insert a node, right-click to remove one.")
+			}
 			if isCreatingBusRoute {
 
 				if gui.Button(rl.NewRectangle(10, 70, 160, 25), "Finish Route") {
 					if client.Connected && len(currentRouteNodes) >= 2 {
-						client.SendBusRoute(currentRouteNodes)
+						client.SendBusRoute(currentRouteNodes, false, currentTransitMode)
+					}
+					isCreatingBusRoute = false
+					currentRouteNodes = []rl.Vector2{}
+				}
+
+				if gui.Button(rl.NewRectangle(180, 70, 150, 25), "Finish Loop") {
+					if len(currentRouteNodes) > 1 && currentRouteNodes[0] == currentRouteNodes[len(currentRouteNodes)-1] {
+						currentRouteNodes = currentRouteNodes[:len(currentRouteNodes)-1]
+					}
+					if client.Connected && len(currentRouteNodes) >= 3 {
+						client.SendBusRoute(currentRouteNodes, true, currentTransitMode)
 					}
 					isCreatingBusRoute = false
 					currentRouteNodes = []rl.Vector2{}
 				}
 
-				if gui.Button(rl.NewRectangle(180, 70, 150, 25), "Cancel Route") {
+				if gui.Button(rl.NewRectangle(340, 70, 150, 25), "Cancel Route") {
 					isCreatingBusRoute = false
 					currentRouteNodes = []rl.Vector2{}
 				}
+			} else {
+				client.mutex.Lock()
+				if len(client.BusRoutes) > 0 {
+					selectedRoute = max(0, min(selectedRoute, len(client.BusRoutes)-1))
+					route := client.BusRoutes[selectedRoute]
+					if gui.Button(rl.NewRectangle(10, 70, 30, 25), "<") {
+						selectedRoute = (selectedRoute + len(client.BusRoutes) - 1) % len(client.BusRoutes)
+					}
+					gui.Label(rl.NewRectangle(50, 70, 230, 20), fmt.Sprintf("%s: %d %s", route.Name, route.Vehicles, getTransitVehicleName(route.Mode)))
+					if gui.Button(rl.NewRectangle(290, 70, 30, 25), ">") {
+						selectedRoute = (selectedRoute + 1) % len(client.BusRoutes)
+					}
+					if gui.Button(rl.NewRectangle(330, 70, 30, 25), "-") && client.Connected {
+						client.SendRouteVehicles(selectedRoute, route.Vehicles-1)
+					}
+					if gui.Button(rl.NewRectangle(370, 70, 30, 25), "+") && client.Connected {
+						client.SendRouteVehicles(selectedRoute, route.Vehicles+1)
+					}
+
+					if currentRouteTool == EditRouteTool {
+						if !routeNameBox.Focused {
+							routeNameBox.Text = route.Name
+						}
+						routeNameBox.Draw()
+						if gui.Button(rl.NewRectangle(460, 40, 90, 25), "Rename") && client.Connected {
+							client.SendRouteName(selectedRoute, routeNameBox.Text)
+							routeNameBox.Focused = false
+						}
+						colorRect := rl.NewRectangle(410, 70, 80, 25)
+						if gui.Button(colorRect, "Color") && client.Connected {
+							client.SendRouteColor(selectedRoute, (route.Color+1)%NUM_ROUTE_COLORS)
+						}
+						rl.DrawRectangle(int32(colorRect.X+colorRect.Width+5), int32(colorRect.Y+4), 16, 16, getRouteColor(route))
+					}
+				}
+				client.mutex.Unlock()
 			}
 		}
 
@@ -540,12 +1453,69 @@ func draw() {
 			gui.Label(rl.NewRectangle(10, 40, 400, 20), "Click near objects to delete them.")
 		}
 
-		gui.Label(rl.NewRectangle(float32(rl.GetScreenWidth()-620), 95, 610, 20), "WASD / Arrows: Move | Mouse Wheel: Zoom | G: Grid | ESC: Menu")
+		if currentBuildMode == ZoningMode {
+			rect := rl.NewRectangle(10, 72, 16, 16)
+			if gui.Button(rl.NewRectangle(10, 40, 120, 25), "Residential") {
+				currentZoneType = Residential
+			}
+			if gui.Button(rl.NewRectangle(140, 40, 90, 25), "Business") {
+				currentZoneType = Commercial
+			}
+			if gui.Button(rl.NewRectangle(240, 40, 100, 25), "Industrial") {
+				currentZoneType = Industrial
+			}
+			if gui.Button(rl.NewRectangle(350, 40, 80, 25), "Clear") {
+				currentZoneType = NoZone
+			}
+			gui.Label(rl.NewRectangle(36, 70, 400, 20), "Zoning: "+getZoneName(currentZoneType)+" (drag along roads)")
+			if currentZoneType != NoZone {
+				rl.DrawRectangleRec(rect, getBuildingColor(currentZoneType))
+			}
+			rl.DrawRectangleLinesEx(rect, 2, rl.Black)
+		}
+
+		gui.Label(rl.NewRectangle(float32(rl.GetScreenWidth()-700), 95, 690, 20), "WASD / Arrows: Move | Mouse Wheel: Zoom | G: Grid | O: Overlay | L: Lines | ESC: Menu")
+		if showRoutesPanel {
+			drawRoutesPanel()
+		}
+		if currentOverlay != NoOverlay {
+			overlayText := "Overlay: " + getOverlayName(currentOverlay)
+			if currentOverlay == GoodsOverlay {
+				overlayText += fmt.Sprintf(" (produced %d, sold %d, exported %d)", client.Goods[0], client.Goods[1], client.Goods[2])
+			}
+			gui.Label(rl.NewRectangle(10, UI_HEIGHT+5, 600, 20), overlayText)
+		}
 		zoomText := fmt.Sprintf("Zoom: %.1fx", zoom)
 		gui.Label(rl.NewRectangle(float32(rl.GetScreenWidth()-120), 10, 100, 20), zoomText)
+		drawDemandBars(float32(rl.GetScreenWidth()-110), 38)
 
 		moneyText := fmt.Sprintf("Money: $%.2f", client.Money)
-		gui.Label(rl.NewRectangle(10, 95, 400, 20), moneyText)
+		gui.Label(rl.NewRectangle(10, 95, 140, 20), moneyText)
+		gui.Label(rl.NewRectangle(150, 95, 55, 20), fmt.Sprintf("Tax: %d%%", client.TaxRate))
+		if gui.Button(rl.NewRectangle(205, 95, 20, 20), "-") && client.TaxRate > 0 {
+			client.SendTaxRate(client.TaxRate - 1)
+		}
+		if gui.Button(rl.NewRectangle(228, 95, 20, 20), "+") && client.TaxRate < MAX_TAX_RATE {
+			client.SendTaxRate(client.TaxRate + 1)
+		}
+		gui.Label(rl.NewRectangle(255, 95, 70, 20), fmt.Sprintf("Rating: %d%%", client.Rating))
+
+		unemployment := 0.0
+		if client.Workforce > 0 {
+			unemployment = float64(max(0, client.Workforce-client.Employed)) / float64(client.Workforce) * 100
+		}
+		gui.Label(rl.NewRectangle(560, 10, 300, 20), fmt.Sprintf("Population: %d", client.Population))
+		gui.Label(rl.NewRectangle(560, 35, 300, 20), fmt.Sprintf("Unemployment: %.0f%%", unemployment))
+		gui.Label(rl.NewRectangle(560, 60, 300, 20), fmt.Sprintf("Vacancies: %d", max(0, client.Jobs-client.Employed)))
+
+		totalCommuters := client.Commuters[WalkCommute] + client.Commuters[DriveCommute] + client.Commuters[TransitCommute]
+		for mode := WalkCommute; mode < numCommuteModes; mode++ {
+			share := 0
+			if totalCommuters > 0 {
+				share = client.Commuters[mode] * 100 / totalCommuters
+			}
+			gui.Label(rl.NewRectangle(720, 10+float32(mode)*25, 180, 20), fmt.Sprintf("%s: %d%%", getCommuteModeName(mode), share))
+		}
 
 	}
 	rl.EndDrawing()
@@ -2,32 +2,84 @@ package main
 
 import (
 	"fmt"
+	"maps"
 	"math"
+	"math/rand"
 	"net"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
+	"unicode/utf8"
 
 	rl "github.com/gen2brain/raylib-go/raylib"
 )
 
 type StoredBuilding struct {
+	X, Y      float32
+	Type      BuildingType
+	PlayerID  string
+	Connected bool
+	Occupants int
+	Capacity  int
+	Watered   bool
+	Powered   bool
+	Commute   float32
+	Supply    float32
+	Happiness float32
+	Abandoned bool
+	Neglect   int
+	Decay     int
+	Level     int
+}
+
+type StoredZone struct {
 	X, Y     float32
 	Type     BuildingType
 	PlayerID string
 }
 
 type StoredBusRoute struct {
+	ID       int
 	Points   []float32
 	PlayerID string
 	Length   float32
+	Riders   int
+	Revenue  float32
+	Vehicles int
+	OpCost   float32
+	Loop     bool
+	Name     string
+	Color    int
+	Owner    string
+	Trips    int
+	Mode     TransitMode
+}
+
+type Truck struct {
+	Path     []rl.Vector2
+	Segment  int
+	Progress float32
+	Position rl.Vector2
+}
+
+type StoredBusStop struct {
+	X, Y      float32
+	Waiting   int
+	PlayerID  string
+	Commuters float32
 }
 
 type StoredLine struct {
 	StartX, StartY, EndX, EndY float32
 	Type                       InfrastructureType
 	PlayerID                   string
+	Class                      RoadClass
+	OneWay                     bool
+	Crossing                   CrossingType
+	Load                       float32
+	Group                      int
 }
 
 type GameState struct {
@@ -50,12 +102,30 @@ type LobbyServer struct {
 	playerConns map[net.Conn]string
 	lines       []StoredLine
 	buildings   []StoredBuilding
+	zones       []StoredZone
 	busRoutes   []StoredBusRoute
+	busStops    []StoredBusStop
 	buses       []Bus
+	trucks      []Truck
 	money       float32
 	incomeRate  float32
+	demand      [3]float32
+	population  int
+	workforce   int
+	employed    int
+	jobs        int
+	commuters   [numCommuteModes]int
+	avgCommute  float32
+	goods       [3]float32
+	heatmaps    [numHeatmapKinds][]float32
+	decorations []float32
+	sentHeat    [numHeatmapKinds]string
+	taxRate     int
+	rating      float32
 	mutex       sync.Mutex
 	running     bool
+	nextRouteID int
+	nextGroup   int
 }
 
 func (s *LobbyServer) Start(port int) error {
@@ -63,10 +133,17 @@ func (s *LobbyServer) Start(port int) error {
 	s.playerConns = make(map[net.Conn]string)
 	s.lines = make([]StoredLine, 0)
 	s.buildings = make([]StoredBuilding, 0)
+	s.zones = make([]StoredZone, 0)
 	s.busRoutes = make([]StoredBusRoute, 0)
+	s.busStops = make([]StoredBusStop, 0)
 	s.buses = make([]Bus, 0)
+	for kind := range s.heatmaps {
+		s.heatmaps[kind] = make([]float32, GRID_CELLS*GRID_CELLS)
+	}
+	s.decorations = make([]float32, GRID_CELLS*GRID_CELLS)
 	s.money = 1000.0
 	s.incomeRate = 0.0
+	s.taxRate = DEFAULT_TAX_RATE
 
 	ln, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
 	if err != nil {
@@ -78,6 +155,7 @@ func (s *LobbyServer) Start(port int) error {
 	go s.cleanupRoutine()
 	go s.updateBusesRoutine()
 	go s.incomeRoutine()
+	go s.simulationRoutine()
 	go func() {
 		for s.running {
 			conn, err := ln.Accept()
@@ -131,7 +209,8 @@ func (s *LobbyServer) cleanupRoutine() {
 	}
 }
 
-// New: incomeRoutine periodically adds money based on incomeRate
+// incomeRoutine periodically adds money based on incomeRate and pays the
+// operating cost of all buses, roads and service buildings
 func (s *LobbyServer) incomeRoutine() {
 	ticker := time.NewTicker(10 * time.Second) // Income every 10 seconds
 	defer ticker.Stop()
@@ -141,14 +220,46 @@ func (s *LobbyServer) incomeRoutine() {
 			break
 		}
 		s.mutex.Lock()
-		if s.incomeRate > 0 { // Only add if there's positive income
-			s.money += s.incomeRate
+		expenses := s.payOperatingCosts() + s.roadUpkeep() + s.serviceUpkeep()
+		if s.incomeRate > 0 || expenses > 0 {
+			s.money += s.incomeRate - expenses
 			s.broadcastMoney()
 		}
 		s.mutex.Unlock()
 	}
 }
 
+// simulationRoutine periodically updates the RCI demand, moves residents and
+// workers in and out of buildings, sends passengers to the bus stops, lets
+// neglected buildings decay and lets buildings grow on zoned land
+func (s *LobbyServer) simulationRoutine() {
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if !s.running {
+			break
+		}
+		s.mutex.Lock()
+		s.updateDemand()
+		s.updatePopulation()
+		loads := make([]float32, len(s.lines))
+		routes := s.newRoadRoutes()
+		s.updateCommutes(loads, routes)
+		s.updateGoods(loads, routes)
+		s.setTraffic(loads)
+		s.updatePollution()
+		s.updateCoverage()
+		s.updateLandValue()
+		s.updateHappiness()
+		s.updateDecay()
+		s.updateIncome()
+		s.updateBusStops()
+		s.growZones()
+		s.mutex.Unlock()
+	}
+}
+
 func (s *LobbyServer) updateBusesRoutine() {
 	ticker := time.NewTicker(50 * time.Millisecond)
 	defer ticker.Stop()
@@ -168,73 +279,63 @@ func (s *LobbyServer) updateBusesRoutine() {
 			}
 
 			storedRoute := s.busRoutes[bus.RouteID]
-			routeNodes := make([]rl.Vector2, len(storedRoute.Points)/2)
-			for j := 0; j < len(storedRoute.Points); j += 2 {
-				routeNodes[j/2] = rl.NewVector2(storedRoute.Points[j], storedRoute.Points[j+1])
-			}
-			currentRoute := BusRoute{Nodes: routeNodes, Length: storedRoute.Length}
+			currentRoute := BusRoute{Nodes: routeNodes(storedRoute), Length: storedRoute.Length, Loop: storedRoute.Loop, Mode: storedRoute.Mode}
 
 			if len(currentRoute.Nodes) < 2 {
 				continue
 			}
 
-			var startNode, endNode rl.Vector2
+			startNode, endNode := segmentEnds(currentRoute.Nodes, bus)
 
-			if bus.Direction == 1 {
-				startNode = currentRoute.Nodes[bus.CurrentSegment]
-				endNode = currentRoute.Nodes[bus.CurrentSegment+1]
-			} else {
-				startNode = currentRoute.Nodes[bus.CurrentSegment+1]
-				endNode = currentRoute.Nodes[bus.CurrentSegment]
+			speed := getTransitSpeed(currentRoute.Mode)
+			if currentRoute.Mode == BusTransit {
+				if roadSpeed := s.roadSpeedAt(bus.Position, startNode, endNode); roadSpeed > 0 {
+					speed = roadSpeed
+				}
 			}
-
 			distance := rl.Vector2Distance(startNode, endNode)
 			if distance > 0 {
-				bus.Progress += (BUS_SPEED / distance) * frameTime
+				bus.Progress += (speed / distance) * frameTime
 			} else {
 				bus.Progress = 1.0
 			}
 
 			if bus.Progress >= 1.0 {
 				bus.Progress = 0.0
-				if bus.Direction == 1 {
+				arrivedNode := bus.CurrentSegment
+				terminal := false
+				if currentRoute.Loop {
+					arrivedNode = (bus.CurrentSegment + 1) % len(currentRoute.Nodes)
+					bus.CurrentSegment = arrivedNode
+				} else if bus.Direction == 1 {
+					arrivedNode = bus.CurrentSegment + 1
 					bus.CurrentSegment++
 					if bus.CurrentSegment >= len(currentRoute.Nodes)-1 {
 						bus.Direction = -1
 						bus.CurrentSegment = len(currentRoute.Nodes) - 2
-
-						if currentRoute.Length > 0 {
-							reward := currentRoute.Length / 16
-							s.money += reward
-						}
-						s.broadcastMoney()
+						terminal = true
 					}
 				} else {
 					bus.CurrentSegment--
 					if bus.CurrentSegment < 0 {
 						bus.Direction = 1
 						bus.CurrentSegment = 0
-
-						if currentRoute.Length > 0 {
-							reward := currentRoute.Length / 16
-							s.money += reward
-						}
-						s.broadcastMoney()
+						terminal = true
 					}
 				}
+				s.serveStop(bus, arrivedNode, terminal)
+				if terminal || (currentRoute.Loop && arrivedNode == 0) {
+					s.busRoutes[bus.RouteID].Trips++
+					s.broadcastToAll(routeStatsMessage(bus.RouteID, s.busRoutes[bus.RouteID]))
+				}
 			}
 
-			if bus.Direction == 1 {
-				startNode = currentRoute.Nodes[bus.CurrentSegment]
-				endNode = currentRoute.Nodes[bus.CurrentSegment+1]
-			} else {
-				startNode = currentRoute.Nodes[bus.CurrentSegment+1]
-				endNode = currentRoute.Nodes[bus.CurrentSegment]
-			}
+			startNode, endNode = segmentEnds(currentRoute.Nodes, bus)
 			bus.Position = rl.Vector2Lerp(startNode, endNode, bus.Progress)
 
-			s.broadcastToAll(fmt.Sprintf("BUS:%d:%.0f:%.0f", i, bus.Position.X, bus.Position.Y))
+			s.broadcastToAll(busMessage(i, *bus))
 		}
+		s.moveTrucks(frameTime)
 		s.mutex.Unlock()
 	}
 }
@@ -329,7 +430,7 @@ func (s *LobbyServer) handleMessage(msg string, conn net.Conn) {
 		} else {
 		}
 	case "I":
-		if len(parts) == 7 {
+		if len(parts) == 10 {
 			s.addInfrastructure(msg, parts)
 		} else {
 		}
@@ -338,11 +439,51 @@ func (s *LobbyServer) handleMessage(msg string, conn net.Conn) {
 			s.addBuilding(msg, parts)
 		} else {
 		}
+	case "UP":
+		if len(parts) == 4 {
+			s.upgradeBuilding(parts)
+		} else {
+		}
 	case "R":
-		if len(parts) >= 6 && (len(parts)-2)%2 == 0 {
+		if len(parts) >= 8 && (len(parts)-4)%2 == 0 {
 			s.addBusRoute(msg, parts)
 		} else {
 		}
+	case "Z":
+		if len(parts) == 7 {
+			s.setZones(parts)
+		} else {
+		}
+	case "S":
+		if len(parts) == 4 {
+			s.toggleBusStop(parts)
+		} else {
+		}
+	case "RV":
+		if len(parts) == 4 {
+			s.setRouteVehicles(parts)
+		} else {
+		}
+	case "TAX":
+		if len(parts) == 3 {
+			s.setTaxRate(parts)
+		} else {
+		}
+	case "RE":
+		if len(parts) >= 7 && (len(parts)-3)%2 == 0 {
+			s.editBusRoute(parts)
+		} else {
+		}
+	case "RNAME":
+		if len(parts) == 4 {
+			s.renameBusRoute(parts)
+		} else {
+		}
+	case "RCOLOR":
+		if len(parts) == 4 {
+			s.recolorBusRoute(parts)
+		} else {
+		}
 	case "D":
 		if len(parts) == 4 {
 			s.deleteObject(parts)
@@ -372,225 +513,2626 @@ func (s *LobbyServer) isPointOnRoad(px, py float32) bool {
 	return false
 }
 
-func (s *LobbyServer) sendFullState(conn net.Conn) {
-	for _, line := range s.lines {
-		lineMsg := fmt.Sprintf("I:%s:%.0f:%.0f:%.0f:%.0f:%d\n",
-			line.PlayerID, line.StartX, line.StartY, line.EndX, line.EndY, int(line.Type))
-		conn.Write([]byte(lineMsg))
+// lineComponents groups the lines of one infrastructure type into connected
+// networks. Lines are joined when they share an endpoint, one ends on the other
+// or they cross each other. Lines of other types get -1.
+func (s *LobbyServer) lineComponents(infraType InfrastructureType) []int {
+	parent := make([]int, len(s.lines))
+	for i := range parent {
+		parent[i] = i
 	}
-	for _, b := range s.buildings {
-		bMsg := fmt.Sprintf("B:%s:%.0f:%.0f:%d\n", b.PlayerID, b.X, b.Y, int(b.Type))
-		conn.Write([]byte(bMsg))
+	var find func(int) int
+	find = func(i int) int {
+		for parent[i] != i {
+			parent[i] = parent[parent[i]]
+			i = parent[i]
+		}
+		return i
 	}
-	for _, r := range s.busRoutes {
-		routeMsg := fmt.Sprintf("R:%s", r.PlayerID)
-		for _, p := range r.Points {
-			routeMsg += fmt.Sprintf(":%.0f", p)
+
+	for i := range s.lines {
+		if s.lines[i].Type != infraType {
+			continue
+		}
+		for j := i + 1; j < len(s.lines); j++ {
+			if s.lines[j].Type != infraType {
+				continue
+			}
+			if linesTouch(s.lines[i], s.lines[j]) {
+				parent[find(i)] = find(j)
+			}
 		}
-		routeMsg += "\n"
-		conn.Write([]byte(routeMsg))
 	}
-	for i, bus := range s.buses {
-		busPosMsg := fmt.Sprintf("BUS:%d:%.0f:%.0f\n", i, bus.Position.X, bus.Position.Y)
-		conn.Write([]byte(busPosMsg))
+
+	components := make([]int, len(s.lines))
+	for i := range s.lines {
+		if s.lines[i].Type != infraType {
+			components[i] = -1
+			continue
+		}
+		components[i] = find(i)
 	}
+	return components
+}
 
-	conn.Write([]byte("STATE_SYNCED\n"))
+// buildingNetworks returns the networks (as returned by lineComponents) a
+// building at (x, y) has direct access to, i.e. lines running through a
+// neighbouring cell.
+func (s *LobbyServer) buildingNetworks(x, y float32, components []int) map[int]bool {
+	access := make(map[int]bool)
+	p := rl.NewVector2(x, y)
+	for i, line := range s.lines {
+		if components[i] < 0 {
+			continue
+		}
+		dist := pointSegmentDistance(p, rl.NewVector2(line.StartX, line.StartY), rl.NewVector2(line.EndX, line.EndY))
+		if dist <= ROAD_ACCESS_DISTANCE {
+			access[components[i]] = true
+		}
+	}
+	return access
 }
 
-func (s *LobbyServer) addInfrastructure(msg string, parts []string) {
-	playerID := parts[1]
-	startX, _ := strconv.ParseFloat(parts[2], 32)
-	startY, _ := strconv.ParseFloat(parts[3], 32)
-	endX, _ := strconv.ParseFloat(parts[4], 32)
-	endY, _ := strconv.ParseFloat(parts[5], 32)
-	infraType, _ := strconv.Atoi(parts[6])
+// updateConnectivity checks every building against the road, water and power
+// networks and recalculates demand and the income rate. Residential buildings only need
+// road access, Commercial and Industrial buildings need a road connection to at
+// least one Residential building for workers (and customers). Service buildings
+// need road access to reach the city, utility buildings don't need roads.
+func (s *LobbyServer) updateConnectivity() {
+	components := s.lineComponents(Road)
+	access := make([]map[int]bool, len(s.buildings))
+	residentialNetworks := make(map[int]bool)
+	for i, b := range s.buildings {
+		access[i] = s.buildingNetworks(b.X, b.Y, components)
+		if b.Type == Residential {
+			for c := range access[i] {
+				residentialNetworks[c] = true
+			}
+		}
+	}
+
+	for i := range s.buildings {
+		b := &s.buildings[i]
+		connected := false
+		if b.Type == Residential || isServiceType(b.Type) {
+			connected = len(access[i]) > 0
+		} else if !isZoneType(b.Type) {
+			connected = true
+		} else {
+			for c := range access[i] {
+				if residentialNetworks[c] {
+					connected = true
+					break
+				}
+			}
+		}
 
-	if InfrastructureType(infraType) == Road {
-		roadStart := rl.NewVector2(float32(startX), float32(startY))
-		roadEnd := rl.NewVector2(float32(endX), float32(endY))
-		roadLength := rl.Vector2Distance(roadStart, roadEnd)
-		cost := roadLength * ROAD_COST_PER_UNIT
+		if connected != b.Connected {
+			b.Connected = connected
+			s.broadcastToAll(buildingStatusMessage(i, *b))
+		}
+	}
 
-		if s.money < cost {
-			s.broadcastToPlayer(playerID, "STATUS:Not enough money to build road!")
-			return
+	s.updateWaterSupply()
+	s.updatePowerSupply()
+	s.updateDemand()
+	s.updateIncome()
+}
+
+// updateWaterSupply marks the buildings supplied by a pump through the pipe
+// network. Pumps only work while there is still a river next to them.
+func (s *LobbyServer) updateWaterSupply() {
+	isPump := func(b StoredBuilding) bool {
+		return b.Type == WaterPump && s.isNearRiver(b.X, b.Y, PUMP_RIVER_DISTANCE)
+	}
+	supplied := s.allocateUtility(WaterPipe, isPump, WATER_PUMP_CAPACITY, func(BuildingType) int { return 1 })
+	for i := range s.buildings {
+		if b := &s.buildings[i]; supplied[i] != b.Watered {
+			b.Watered = supplied[i]
+			s.broadcastToAll(buildingStatusMessage(i, *b))
 		}
-		s.money -= cost
-		s.broadcastMoney()
 	}
+}
 
-	newLine := StoredLine{
-		StartX: float32(startX), StartY: float32(startY),
-		EndX: float32(endX), EndY: float32(endY),
-		Type: InfrastructureType(infraType), PlayerID: playerID,
+// updatePowerSupply marks the buildings powered by a power plant through the
+// power line network.
+func (s *LobbyServer) updatePowerSupply() {
+	isPlant := func(b StoredBuilding) bool { return b.Type == PowerPlant }
+	supplied := s.allocateUtility(PowerLine, isPlant, POWER_PLANT_CAPACITY, getPowerUsage)
+	for i := range s.buildings {
+		if b := &s.buildings[i]; supplied[i] != b.Powered {
+			b.Powered = supplied[i]
+			s.broadcastToAll(buildingStatusMessage(i, *b))
+		}
 	}
-	s.lines = append(s.lines, newLine)
-	s.broadcastToAll(msg)
 }
 
-func (s *LobbyServer) addBuilding(msg string, parts []string) {
-	playerID := parts[1]
-	x, _ := strconv.ParseFloat(parts[2], 32)
-	y, _ := strconv.ParseFloat(parts[3], 32)
-	buildingTypeInt, _ := strconv.Atoi(parts[4])
-	buildingType := BuildingType(buildingTypeInt)
+// allocateUtility hands out the capacity of the source buildings attached to
+// each network of lineType to the zoned buildings along it, in placement order.
+// A source next to several networks only feeds the one with the lowest id, and
+// buildings try their networks in the same order so their supply doesn't flip
+// between ticks. It returns which buildings got their full usage.
+func (s *LobbyServer) allocateUtility(lineType InfrastructureType, isSource func(StoredBuilding) bool, sourceCapacity int, usage func(BuildingType) int) []bool {
+	components := s.lineComponents(lineType)
+	capacity := make(map[int]int)
+	access := make([]map[int]bool, len(s.buildings))
+	for i, b := range s.buildings {
+		access[i] = s.buildingNetworks(b.X, b.Y, components)
+		if isSource(b) && len(access[i]) > 0 {
+			capacity[slices.Min(slices.Collect(maps.Keys(access[i])))] += sourceCapacity
+		}
+	}
 
-	var cost float32
-	var incomeIncrease float32
+	supplied := make([]bool, len(s.buildings))
+	for i, b := range s.buildings {
+		if !isZoneType(b.Type) {
+			continue
+		}
+		needed := usage(b.Type)
+		for _, c := range slices.Sorted(maps.Keys(access[i])) {
+			if capacity[c] >= needed {
+				capacity[c] -= needed
+				supplied[i] = true
+				break
+			}
+		}
+	}
+	return supplied
+}
 
+func getPowerUsage(buildingType BuildingType) int {
 	switch buildingType {
 	case Residential:
-		cost = RESIDENTIAL_BUILDING_COST
+		return 1
 	case Commercial:
-		cost = COMMERCIAL_BUILDING_COST
-		incomeIncrease = COMMERCIAL_INCOME_INCREASE
+		return 2
 	case Industrial:
-		cost = INDUSTRIAL_BUILDING_COST
-		incomeIncrease = INDUSTRIAL_INCOME_INCREASE
+		return 5
 	default:
-		s.broadcastToPlayer(playerID, "STATUS:Unknown building type!")
-		return
+		return 0
 	}
+}
 
-	if s.money < cost {
-		s.broadcastToPlayer(playerID, fmt.Sprintf("STATUS:Not enough money to build %s! Cost: %.2f", getBuildingName(buildingType), cost))
-		return
+// updateIncome sums the income of all connected buildings, scaled by their
+// level, how many of their jobs are filled, the current demand for their type
+// and the tax rate. Workplaces without power and abandoned buildings don't earn anything.
+func (s *LobbyServer) updateIncome() {
+	s.incomeRate = 0
+	for _, b := range s.buildings {
+		if !b.Connected || b.Capacity == 0 || b.Abandoned || (isWorkplace(b.Type) && !b.Powered) {
+			continue
+		}
+		income := getBuildingIncome(b.Type) * float32(b.Level) * float32(b.Occupants) / float32(b.Capacity)
+		if isZoneType(b.Type) {
+			income *= 1 + s.demand[b.Type]*DEMAND_INCOME_FACTOR
+		}
+		if !b.Watered {
+			income *= NO_WATER_INCOME_FACTOR
+		}
+		if isWorkplace(b.Type) {
+			income *= NO_GOODS_INCOME_FACTOR + (1-NO_GOODS_INCOME_FACTOR)*b.Supply
+		}
+		income *= MIN_LAND_VALUE_INCOME + s.heatmapAt(LandValueHeatmap, b.X, b.Y)/MAX_LAND_VALUE
+		income *= float32(s.taxRate) / DEFAULT_TAX_RATE
+		s.incomeRate += income
 	}
+}
 
-	s.money -= cost
-	s.incomeRate += incomeIncrease // Add income for Commercial/Industrial
-	s.broadcastMoney()
+// updatePopulation lets residents move into connected Residential buildings
+// while there is residential demand (and out again when the building loses its
+// road, the demand collapses or they are too unhappy), then spreads the
+// workforce over the jobs of connected Commercial and Industrial buildings.
+func (s *LobbyServer) updatePopulation() {
+	population := 0
+	for i, b := range s.buildings {
+		if b.Type != Residential {
+			continue
+		}
+		occupants := b.Occupants
+		step := int(math.Ceil(float64(b.Capacity) * OCCUPANCY_CHANGE_RATE))
+		maxOccupants := b.Capacity
+		if !b.Watered {
+			maxOccupants = int(float64(b.Capacity) * NO_WATER_MAX_OCCUPANCY)
+		}
+		maxOccupants = int(float32(maxOccupants) * (MIN_HAPPY_OCCUPANCY + (1-MIN_HAPPY_OCCUPANCY)*b.Happiness))
+		if b.Abandoned {
+			occupants = 0
+		} else if !b.Connected || s.demand[Residential] < RESIDENTIAL_MOVE_OUT_DEMAND || b.Happiness < MOVE_OUT_HAPPINESS {
+			occupants -= step
+		} else if occupants > maxOccupants {
+			occupants = max(occupants-step, maxOccupants)
+		} else if s.demand[Residential] > 0 {
+			occupants = min(occupants+step, maxOccupants)
+		}
+		s.setOccupants(i, occupants)
+		population += s.buildings[i].Occupants
+	}
 
-	newBuilding := StoredBuilding{
-		X: float32(x), Y: float32(y),
-		Type: buildingType, PlayerID: playerID,
+	jobs := 0
+	for _, b := range s.buildings {
+		if isWorkplace(b.Type) && b.Connected && !b.Abandoned {
+			jobs += b.Capacity
+		}
+	}
+	workforce := int(float32(population) * WORKFORCE_RATIO)
+	var employmentShare float64
+	if jobs > 0 {
+		employmentShare = math.Min(1, float64(workforce)/float64(jobs))
 	}
-	s.buildings = append(s.buildings, newBuilding)
-	s.broadcastToAll(msg)
-}
 
-func (s *LobbyServer) addBusRoute(msg string, parts []string) {
-	playerID := parts[1]
-	points := make([]float32, 0, len(parts)-2)
-	nodes := make([]rl.Vector2, 0, (len(parts)-2)/2)
-	for i := 2; i < len(parts); i += 2 {
-		x, errX := strconv.ParseFloat(parts[i], 32)
-		y, errY := strconv.ParseFloat(parts[i+1], 32)
-		if errX == nil && errY == nil {
-			points = append(points, float32(x), float32(y))
-			nodes = append(nodes, rl.NewVector2(float32(x), float32(y)))
-		} else {
-			s.broadcastToPlayer(playerID, "STATUS:Invalid coordinates for bus route node.")
-			return
+	employed := 0
+	for i, b := range s.buildings {
+		if !isWorkplace(b.Type) {
+			continue
 		}
+		target := 0
+		if b.Connected && !b.Abandoned {
+			target = int(float64(b.Capacity) * employmentShare)
+		}
+		step := int(math.Ceil(float64(b.Capacity) * OCCUPANCY_CHANGE_RATE))
+		occupants := b.Occupants
+		if occupants < target {
+			occupants = min(occupants+step, target)
+		} else if occupants > target {
+			occupants = max(occupants-step, target)
+		}
+		s.setOccupants(i, occupants)
+		employed += s.buildings[i].Occupants
 	}
 
-	if len(nodes) < 2 {
-		s.broadcastToPlayer(playerID, "STATUS:Bus route needs at least 2 nodes!")
-		return
+	if population != s.population || workforce != s.workforce || employed != s.employed || jobs != s.jobs {
+		s.population, s.workforce, s.employed, s.jobs = population, workforce, employed, jobs
+		s.broadcastToAll(s.statsMessage())
 	}
+}
 
-	var totalLength float32
-	allSegmentsOnRoad := true
-	const intermediatePointsPerSegment = 4
-	for i := 0; i < len(nodes)-1; i++ {
-		segmentStart := nodes[i]
-		segmentEnd := nodes[i+1]
-		segmentLength := rl.Vector2Distance(segmentStart, segmentEnd)
-		totalLength += segmentLength
+func (s *LobbyServer) setOccupants(index int, occupants int) {
+	b := &s.buildings[index]
+	occupants = max(0, min(occupants, b.Capacity))
+	if occupants != b.Occupants {
+		b.Occupants = occupants
+		s.broadcastToAll(buildingStatusMessage(index, *b))
+	}
+}
 
-		for p := 0; p <= intermediatePointsPerSegment; p++ {
-			t := float32(p) / float32(intermediatePointsPerSegment)
-			intermediatePoint := rl.Vector2Lerp(segmentStart, segmentEnd, t)
-			if !s.isPointOnRoad(intermediatePoint.X, intermediatePoint.Y) {
-				allSegmentsOnRoad = false
-				break
-			}
+func (s *LobbyServer) statsMessage() string {
+	return fmt.Sprintf("STATS:%d:%d:%d:%d", s.population, s.workforce, s.employed, s.jobs)
+}
+
+// updateDemand computes residential, commercial and industrial demand from the
+// population and jobs of all connected buildings and the transit service
+// available. Each demand ranges from -1 (oversupplied) to 1 (strong demand).
+func (s *LobbyServer) updateDemand() {
+	var population, commercialJobs, industrialJobs float32
+	for _, b := range s.buildings {
+		if !b.Connected || b.Abandoned {
+			continue
 		}
-		if !allSegmentsOnRoad {
-			break
+		switch b.Type {
+		case Residential:
+			population += float32(b.Occupants)
+		case Commercial:
+			commercialJobs += float32(b.Capacity)
+		case Industrial:
+			industrialJobs += float32(b.Capacity)
 		}
 	}
 
-	if !allSegmentsOnRoad {
-		s.broadcastToPlayer(playerID, "STATUS:Bus route must be fully on roads!")
-		return
+	workforce := population * WORKFORCE_RATIO
+	jobs := commercialJobs + industrialJobs + BASE_RESIDENTIAL_DEMAND
+	serviceBonus := float32(math.Min(float64(len(s.busRoutes))*TRANSIT_SERVICE_DEMAND_BONUS, MAX_SERVICE_DEMAND_BONUS))
+
+	newDemand := [3]float32{
+		demandRatio(jobs, workforce) + serviceBonus,
+		demandRatio(population*COMMERCIAL_JOBS_PER_RESIDENT, commercialJobs),
+		demandRatio(population*INDUSTRIAL_JOBS_PER_RESIDENT, industrialJobs),
+	}
+	for i := range newDemand {
+		newDemand[i] = float32(math.Max(-1, math.Min(1, float64(newDemand[i]))))
 	}
 
-	newRoute := StoredBusRoute{
-		Points:   points,
-		PlayerID: playerID,
-		Length:   totalLength,
+	if newDemand != s.demand {
+		s.demand = newDemand
+		s.broadcastToAll(s.demandMessage())
 	}
-	s.busRoutes = append(s.busRoutes, newRoute)
+}
 
-	newBus := Bus{
-		RouteID:        len(s.busRoutes) - 1,
-		Position:       nodes[0],
-		CurrentSegment: 0,
-		Progress:       0.0,
-		Direction:      1,
+// demandRatio compares what is wanted with what is already there.
+func demandRatio(wanted, existing float32) float32 {
+	total := float32(math.Max(float64(wanted), float64(existing)))
+	if total <= 0 {
+		return 0
 	}
-	s.buses = append(s.buses, newBus)
+	return (wanted - existing) / total
+}
 
-	s.broadcastToAll(msg)
-	s.broadcastToAll(fmt.Sprintf("BUS:%d:%.0f:%.0f", len(s.buses)-1, newBus.Position.X, newBus.Position.Y))
+func (s *LobbyServer) demandMessage() string {
+	return fmt.Sprintf("DEMAND:%.2f:%.2f:%.2f", s.demand[Residential], s.demand[Commercial], s.demand[Industrial])
 }
 
-func (s *LobbyServer) deleteObject(parts []string) {
-	playerID := parts[1]
-	x, _ := strconv.ParseFloat(parts[2], 32)
-	y, _ := strconv.ParseFloat(parts[3], 32)
-	deleteRadius := float64(GRID_SIZE * 0.75)
-	deletedSomething := false
+func getBuildingCapacity(buildingType BuildingType) int {
+	switch buildingType {
+	case Residential:
+		return RESIDENTS_PER_BUILDING
+	case Commercial:
+		return COMMERCIAL_JOBS_PER_BUILDING
+	case Industrial:
+		return INDUSTRIAL_JOBS_PER_BUILDING
+	default:
+		return 0
+	}
+}
 
-	deletedRoadIndices := make(map[int]bool)
-	var deletedBuildingType BuildingType = -1 // Store type of deleted building if any
+func isZoneType(buildingType BuildingType) bool {
+	return buildingType == Residential || buildingType == Commercial || buildingType == Industrial
+}
 
-	for i := len(s.buildings) - 1; i >= 0; i-- {
-		b := s.buildings[i]
-		dist := math.Sqrt(math.Pow(float64(b.X)-x, 2) + math.Pow(float64(b.Y)-y, 2))
-		if dist <= deleteRadius {
-			deletedBuildingType = b.Type // Store type before deletion
-			s.buildings = append(s.buildings[:i], s.buildings[i+1:]...)
-			deletedSomething = true
-			break
-		}
+func isWorkplace(buildingType BuildingType) bool {
+	return buildingType == Commercial || buildingType == Industrial
+}
+
+func isDecorationType(buildingType BuildingType) bool {
+	return buildingType == Park || buildingType == Plaza || buildingType == Tree
+}
+
+// getDecorationEffect returns the radius a park, plaza or tree makes more
+// pleasant and how strongly, from 0 to 1, it does so at its center.
+func getDecorationEffect(buildingType BuildingType) (float32, float32) {
+	switch buildingType {
+	case Park:
+		return PARK_RADIUS, 1
+	case Plaza:
+		return PLAZA_RADIUS, PLAZA_STRENGTH
+	case Tree:
+		return TREE_RADIUS, TREE_STRENGTH
+	default:
+		return 0, 0
 	}
+}
 
-	// Adjust income if a building was deleted
-	if deletedSomething && deletedBuildingType != -1 {
-		switch deletedBuildingType {
-		case Commercial:
-			s.incomeRate -= COMMERCIAL_INCOME_INCREASE
-		case Industrial:
-			s.incomeRate -= INDUSTRIAL_INCOME_INCREASE
-		}
-		if s.incomeRate < 0 { // Ensure income rate doesn't go below zero
-			s.incomeRate = 0
-		}
-		s.broadcastMoney()
+// decorationBonus returns the strongest effect of the parks, plazas and trees
+// around a position, from 0 to 1, as spread by the last updateLandValue.
+func (s *LobbyServer) decorationBonus(x, y float32) float32 {
+	if cell, ok := cellIndex(x, y); ok {
+		return s.decorations[cell]
 	}
+	return 0
+}
 
-	if !deletedSomething {
-		for i := len(s.lines) - 1; i >= 0; i-- {
-			l := s.lines[i]
-			distStart := math.Sqrt(math.Pow(float64(l.StartX)-x, 2) + math.Pow(float64(l.StartY)-y, 2))
-			distEnd := math.Sqrt(math.Pow(float64(l.EndX)-x, 2) + math.Pow(float64(l.EndY)-y, 2))
-			lineSegmentDist := pointSegmentDistance(rl.NewVector2(float32(x), float32(y)), rl.NewVector2(l.StartX, l.StartY), rl.NewVector2(l.EndX, l.EndY))
+func isServiceType(buildingType BuildingType) bool {
+	return buildingType == PoliceStation || buildingType == FireStation || buildingType == Clinic || buildingType == School
+}
 
-			if distStart <= deleteRadius || distEnd <= deleteRadius || lineSegmentDist <= float32(deleteRadius) {
-				if l.Type == Road {
-					roadStart := rl.NewVector2(l.StartX, l.StartY)
-					roadEnd := rl.NewVector2(l.EndX, l.EndY)
-					roadLength := rl.Vector2Distance(roadStart, roadEnd)
-					refund := roadLength * ROAD_COST_PER_UNIT
-					s.money += refund
-					s.broadcastMoney()
-					deletedRoadIndices[i] = true
-				}
-				s.lines = append(s.lines[:i], s.lines[i+1:]...)
+// getServiceHeatmap returns the coverage heatmap of a service building.
+func getServiceHeatmap(buildingType BuildingType) HeatmapKind {
+	switch buildingType {
+	case FireStation:
+		return FireHeatmap
+	case Clinic:
+		return HealthHeatmap
+	case School:
+		return EducationHeatmap
+	default:
+		return PoliceHeatmap
+	}
+}
+
+func getServiceRadius(buildingType BuildingType) float32 {
+	switch buildingType {
+	case PoliceStation:
+		return POLICE_RADIUS
+	case FireStation:
+		return FIRE_RADIUS
+	case Clinic:
+		return CLINIC_RADIUS
+	case School:
+		return SCHOOL_RADIUS
+	default:
+		return 0
+	}
+}
+
+func getServiceOperatingCost(buildingType BuildingType) float32 {
+	switch buildingType {
+	case PoliceStation:
+		return POLICE_OPERATING_COST
+	case FireStation:
+		return FIRE_OPERATING_COST
+	case Clinic:
+		return CLINIC_OPERATING_COST
+	case School:
+		return SCHOOL_OPERATING_COST
+	default:
+		return 0
+	}
+}
+
+// serviceUpkeep returns the operating cost of all service buildings for one
+// income tick.
+func (s *LobbyServer) serviceUpkeep() float32 {
+	var total float32
+	for _, b := range s.buildings {
+		total += getServiceOperatingCost(b.Type)
+	}
+	return total
+}
+
+func getBuildingIncome(buildingType BuildingType) float32 {
+	switch buildingType {
+	case Commercial:
+		return COMMERCIAL_INCOME_INCREASE
+	case Industrial:
+		return INDUSTRIAL_INCOME_INCREASE
+	default:
+		return 0
+	}
+}
+
+func buildingStatusMessage(index int, b StoredBuilding) string {
+	connected := 0
+	if b.Connected {
+		connected = 1
+	}
+	watered := 0
+	if b.Watered {
+		watered = 1
+	}
+	powered := 0
+	if b.Powered {
+		powered = 1
+	}
+	abandoned := 0
+	if b.Abandoned {
+		abandoned = 1
+	}
+	return fmt.Sprintf("BSTATUS:%d:%d:%d:%d:%d:%d:%d:%d:%d:%d:%d", index, connected, b.Occupants, b.Capacity, watered, powered, int(b.Supply*100), int(b.Happiness*100), abandoned, b.Decay*100/COLLAPSE_AFTER_TICKS, b.Level)
+}
+
+func (s *LobbyServer) sendFullState(conn net.Conn) {
+	for _, line := range s.lines {
+		conn.Write([]byte(lineMessage(line) + "\n"))
+	}
+	conn.Write([]byte(s.trafficMessage() + "\n"))
+	conn.Write([]byte(s.commuteMessage() + "\n"))
+	conn.Write([]byte(s.goodsMessage() + "\n"))
+	for kind := range s.heatmaps {
+		conn.Write([]byte(s.heatmapMessage(HeatmapKind(kind)) + "\n"))
+	}
+	for _, b := range s.buildings {
+		bMsg := fmt.Sprintf("B:%s:%.0f:%.0f:%d\n", b.PlayerID, b.X, b.Y, int(b.Type))
+		conn.Write([]byte(bMsg))
+	}
+	for i, b := range s.buildings {
+		conn.Write([]byte(buildingStatusMessage(i, b) + "\n"))
+	}
+	for _, z := range s.zones {
+		conn.Write([]byte(zoneMessage(z) + "\n"))
+	}
+	conn.Write([]byte(s.demandMessage() + "\n"))
+	conn.Write([]byte(s.statsMessage() + "\n"))
+	conn.Write([]byte(s.taxRateMessage() + "\n"))
+	conn.Write([]byte(s.ratingMessage() + "\n"))
+	for _, r := range s.busRoutes {
+		loop := 0
+		if r.Loop {
+			loop = 1
+		}
+		routeMsg := fmt.Sprintf("R:%s:%d:%d", r.PlayerID, loop, r.Mode)
+		for _, p := range r.Points {
+			routeMsg += fmt.Sprintf(":%.0f", p)
+		}
+		routeMsg += "\n"
+		conn.Write([]byte(routeMsg))
+	}
+	for i, r := range s.busRoutes {
+		conn.Write([]byte(routeInfoMessage(i, r) + "\n"))
+	}
+	for i, bus := range s.buses {
+		conn.Write([]byte(busMessage(i, bus) + "\n"))
+	}
+	for _, stop := range s.busStops {
+		conn.Write([]byte(busStopMessage(stop) + "\n"))
+	}
+	for i, r := range s.busRoutes {
+		conn.Write([]byte(routeStatsMessage(i, r) + "\n"))
+	}
+
+	conn.Write([]byte("STATE_SYNCED\n"))
+}
+
+func lineMessage(line StoredLine) string {
+	oneWay := 0
+	if line.OneWay {
+		oneWay = 1
+	}
+	return fmt.Sprintf("I:%s:%.0f:%.0f:%.0f:%.0f:%d:%d:%d:%d",
+		line.PlayerID, line.StartX, line.StartY, line.EndX, line.EndY, int(line.Type), int(line.Class), oneWay, int(line.Crossing))
+}
+
+func (s *LobbyServer) addInfrastructure(msg string, parts []string) {
+	playerID := parts[1]
+	startX, _ := strconv.ParseFloat(parts[2], 32)
+	startY, _ := strconv.ParseFloat(parts[3], 32)
+	endX, _ := strconv.ParseFloat(parts[4], 32)
+	endY, _ := strconv.ParseFloat(parts[5], 32)
+	infraType, _ := strconv.Atoi(parts[6])
+	class, err := strconv.Atoi(parts[7])
+	if err != nil || class < 0 || class >= int(numRoadClasses) || (InfrastructureType(infraType) != Road && RoadClass(class) != Street) {
+		s.broadcastToPlayer(playerID, "STATUS:Unknown road class!")
+		return
+	}
+	oneWay := parts[8] == "1"
+	if oneWay && InfrastructureType(infraType) != Road {
+		s.broadcastToPlayer(playerID, "STATUS:Only roads can be one-way!")
+		return
+	}
+	crossing := Bridge
+	if parts[9] == strconv.Itoa(int(Tunnel)) {
+		crossing = Tunnel
+	}
+
+	newLine := StoredLine{
+		StartX: float32(startX), StartY: float32(startY),
+		EndX: float32(endX), EndY: float32(endY),
+		Type: InfrastructureType(infraType), PlayerID: playerID,
+		Class: RoadClass(class), OneWay: oneWay,
+	}
+	if !isOnMap(rl.NewVector2(newLine.StartX, newLine.StartY)) || !isOnMap(rl.NewVector2(newLine.EndX, newLine.EndY)) {
+		s.broadcastToPlayer(playerID, "STATUS:Lines must stay on the map!")
+		return
+	}
+	if cost := lineCost(newLine); cost > 0 && s.money < cost {
+		s.broadcastToPlayer(playerID, fmt.Sprintf("STATUS:Not enough money to build %s! Cost: %.2f", getInfrastructureName(newLine.Type), cost))
+		return
+	}
+	pieces := []StoredLine{newLine}
+	if newLine.Type == Road {
+		var ok bool
+		pieces, ok = s.splitAtWater(playerID, newLine, crossing)
+		if !ok {
+			return
+		}
+	}
+
+	var cost float32
+	for _, piece := range pieces {
+		cost += lineCost(piece)
+	}
+	if cost > 0 {
+		if s.money < cost {
+			s.broadcastToPlayer(playerID, fmt.Sprintf("STATUS:Not enough money to build %s! Cost: %.2f", getInfrastructureName(newLine.Type), cost))
+			return
+		}
+		s.money -= cost
+		s.broadcastMoney()
+	}
+
+	if len(pieces) > 1 {
+		s.nextGroup++
+	}
+	for _, piece := range pieces {
+		if len(pieces) > 1 {
+			piece.Group = s.nextGroup
+		}
+		s.lines = append(s.lines, piece)
+		s.broadcastToAll(lineMessage(piece))
+	}
+
+	if newLine.Type != Water {
+		s.updateConnectivity()
+	}
+}
+
+// splitAtWater cuts a road into land pieces and bridge or tunnel pieces where
+// it crosses a river. Roads that start or end in a river or follow one are
+// refused.
+func (s *LobbyServer) splitAtWater(playerID string, line StoredLine, crossing CrossingType) ([]StoredLine, bool) {
+	start := rl.NewVector2(line.StartX, line.StartY)
+	end := rl.NewVector2(line.EndX, line.EndY)
+	length := rl.Vector2Distance(start, end)
+	const step = 4.0
+	samples := int(math.Ceil(float64(length / step)))
+	if samples == 0 {
+		return []StoredLine{line}, true
+	}
+
+	pointAt := func(t float32) rl.Vector2 {
+		p := rl.Vector2Lerp(start, end, t)
+		return rl.NewVector2(float32(math.Round(float64(p.X))), float32(math.Round(float64(p.Y))))
+	}
+	pieceBetween := func(from, to float32, pieceCrossing CrossingType) StoredLine {
+		piece := line
+		a, b := pointAt(from), pointAt(to)
+		piece.StartX, piece.StartY, piece.EndX, piece.EndY = a.X, a.Y, b.X, b.Y
+		piece.Crossing = pieceCrossing
+		return piece
+	}
+
+	pieces := make([]StoredLine, 0, 1)
+	landStart := float32(0)
+	runStart := -1
+	for i := 0; i <= samples; i++ {
+		t := float32(i) / float32(samples)
+		p := rl.Vector2Lerp(start, end, t)
+		wet := s.isNearRiver(p.X, p.Y, RIVER_HALF_WIDTH)
+		if wet && runStart == -1 {
+			if i == 0 {
+				s.broadcastToPlayer(playerID, "STATUS:Roads can't start or end in a river!")
+				return nil, false
+			}
+			runStart = i - 1
+		}
+		if wet && i == samples {
+			s.broadcastToPlayer(playerID, "STATUS:Roads can't start or end in a river!")
+			return nil, false
+		}
+		if !wet && runStart != -1 {
+			from, to := float32(runStart)/float32(samples), t
+			if (to-from)*length > MAX_BRIDGE_LENGTH {
+				if s.isAlongRiver(pointAt(from), pointAt(to)) {
+					s.broadcastToPlayer(playerID, "STATUS:Roads can't run along a river!")
+				} else {
+					s.broadcastToPlayer(playerID, fmt.Sprintf("STATUS:River crossings can be at most %d long!", MAX_BRIDGE_LENGTH))
+				}
+				return nil, false
+			}
+			if from > landStart {
+				pieces = append(pieces, pieceBetween(landStart, from, NoCrossing))
+			}
+			pieces = append(pieces, pieceBetween(from, to, crossing))
+			landStart = to
+			runStart = -1
+		}
+	}
+	if landStart < 1 {
+		pieces = append(pieces, pieceBetween(landStart, 1, NoCrossing))
+	}
+	return pieces, true
+}
+
+// isAlongRiver reports whether a stretch of road follows a river instead of
+// crossing it.
+func (s *LobbyServer) isAlongRiver(from, to rl.Vector2) bool {
+	direction := rl.Vector2Normalize(rl.Vector2Subtract(to, from))
+	middle := rl.Vector2Lerp(from, to, 0.5)
+	for _, line := range s.lines {
+		if line.Type != Water {
+			continue
+		}
+		start, end := rl.NewVector2(line.StartX, line.StartY), rl.NewVector2(line.EndX, line.EndY)
+		if pointSegmentDistance(middle, start, end) > RIVER_HALF_WIDTH {
+			continue
+		}
+		if math.Abs(float64(rl.Vector2DotProduct(direction, rl.Vector2Normalize(rl.Vector2Subtract(end, start))))) > 0.9 {
+			return true
+		}
+	}
+	return false
+}
+
+// lineCost is the build cost of a line, which is also refunded when it is
+// deleted.
+func lineCost(line StoredLine) float32 {
+	length := rl.Vector2Distance(rl.NewVector2(line.StartX, line.StartY), rl.NewVector2(line.EndX, line.EndY))
+	cost := length * getInfrastructureCost(line.Type, line.Class)
+	switch line.Crossing {
+	case Bridge:
+		cost *= BRIDGE_COST_MULTIPLIER
+	case Tunnel:
+		cost *= TUNNEL_COST_MULTIPLIER
+	}
+	return cost
+}
+
+func getInfrastructureCost(infraType InfrastructureType, class RoadClass) float32 {
+	switch infraType {
+	case Road:
+		switch class {
+		case Avenue:
+			return AVENUE_COST_PER_UNIT
+		case Highway:
+			return HIGHWAY_COST_PER_UNIT
+		default:
+			return ROAD_COST_PER_UNIT
+		}
+	case WaterPipe:
+		return PIPE_COST_PER_UNIT
+	case PowerLine:
+		return POWER_LINE_COST_PER_UNIT
+	default:
+		return 0
+	}
+}
+
+func getRoadUpkeep(class RoadClass) float32 {
+	switch class {
+	case Avenue:
+		return AVENUE_UPKEEP_PER_UNIT
+	case Highway:
+		return HIGHWAY_UPKEEP_PER_UNIT
+	default:
+		return STREET_UPKEEP_PER_UNIT
+	}
+}
+
+// getRoadCapacity is the number of vehicles a road segment carries before it
+// gets congested.
+func getRoadCapacity(class RoadClass) int {
+	switch class {
+	case Avenue:
+		return AVENUE_CAPACITY
+	case Highway:
+		return HIGHWAY_CAPACITY
+	default:
+		return STREET_CAPACITY
+	}
+}
+
+func getRoadSpeed(class RoadClass) float32 {
+	switch class {
+	case Avenue:
+		return AVENUE_SPEED
+	case Highway:
+		return HIGHWAY_SPEED
+	default:
+		return STREET_SPEED
+	}
+}
+
+// roadUpkeep returns the maintenance cost of all roads for one income tick.
+func (s *LobbyServer) roadUpkeep() float32 {
+	var total float32
+	for _, line := range s.lines {
+		if line.Type != Road {
+			continue
+		}
+		length := rl.Vector2Distance(rl.NewVector2(line.StartX, line.StartY), rl.NewVector2(line.EndX, line.EndY))
+		total += length * getRoadUpkeep(line.Class)
+	}
+	return total
+}
+
+// roadSpeedAt returns the congested speed of the road a vehicle at a position
+// drives on while heading from one point to another, i.e. the nearby road best
+// aligned with that direction, or 0 if the position is not on a road.
+func (s *LobbyServer) roadSpeedAt(pos, from, to rl.Vector2) float32 {
+	direction := rl.Vector2Normalize(rl.Vector2Subtract(to, from))
+	var speed float32
+	bestAlignment := float32(-1)
+	for _, line := range s.lines {
+		if line.Type != Road {
+			continue
+		}
+		start, end := rl.NewVector2(line.StartX, line.StartY), rl.NewVector2(line.EndX, line.EndY)
+		if pointSegmentDistance(pos, start, end) > ROAD_SNAP_DISTANCE {
+			continue
+		}
+		alignment := float32(math.Abs(float64(rl.Vector2DotProduct(direction, rl.Vector2Normalize(rl.Vector2Subtract(end, start))))))
+		if alignment > bestAlignment {
+			bestAlignment = alignment
+			speed = getRoadSpeed(line.Class) * congestionFactor(line)
+		}
+	}
+	return speed
+}
+
+// congestionFactor scales the speed on a road down as its load approaches
+// and exceeds its capacity.
+func congestionFactor(line StoredLine) float32 {
+	ratio := float64(line.Load) / float64(getRoadCapacity(line.Class))
+	return max(MIN_TRAFFIC_SPEED_FACTOR, float32(1/(1+TRAFFIC_SLOWDOWN*math.Pow(ratio, 4))))
+}
+
+func travelTime(line StoredLine) float32 {
+	length := rl.Vector2Distance(rl.NewVector2(line.StartX, line.StartY), rl.NewVector2(line.EndX, line.EndY))
+	return length / (getRoadSpeed(line.Class) * congestionFactor(line))
+}
+
+// roadGraph returns for every road the roads a vehicle can turn onto.
+func (s *LobbyServer) roadGraph() [][]int {
+	graph := make([][]int, len(s.lines))
+	for i, a := range s.lines {
+		if a.Type != Road {
+			continue
+		}
+		for j, b := range s.lines {
+			if i != j && b.Type == Road && linesTouch(a, b) && canTurn(a, b) {
+				graph[i] = append(graph[i], j)
+			}
+		}
+	}
+	return graph
+}
+
+// canTurn reports whether a vehicle on road a may continue onto road b. One-way
+// roads can't be left at their start or entered at their end.
+func canTurn(a, b StoredLine) bool {
+	point := touchPoint(a, b)
+	if a.OneWay && rl.Vector2Distance(point, rl.NewVector2(a.StartX, a.StartY)) <= ROAD_SNAP_DISTANCE {
+		return false
+	}
+	if b.OneWay && rl.Vector2Distance(point, rl.NewVector2(b.EndX, b.EndY)) <= ROAD_SNAP_DISTANCE {
+		return false
+	}
+	return true
+}
+
+func touchPoint(a, b StoredLine) rl.Vector2 {
+	a1, a2 := rl.NewVector2(a.StartX, a.StartY), rl.NewVector2(a.EndX, a.EndY)
+	b1, b2 := rl.NewVector2(b.StartX, b.StartY), rl.NewVector2(b.EndX, b.EndY)
+
+	var collision rl.Vector2
+	if rl.CheckCollisionLines(a1, a2, b1, b2, &collision) {
+		return collision
+	}
+	best, bestDist := a1, pointSegmentDistance(a1, b1, b2)
+	if d := pointSegmentDistance(a2, b1, b2); d < bestDist {
+		best, bestDist = a2, d
+	}
+	if d := pointSegmentDistance(b1, a1, a2); d < bestDist {
+		best, bestDist = b1, d
+	}
+	if d := pointSegmentDistance(b2, a1, a2); d < bestDist {
+		best = b2
+	}
+	return best
+}
+
+// shortestPaths finds the fastest way from a road to every other road. It
+// returns the travel time to each road and the road it is reached from.
+func (s *LobbyServer) shortestPaths(graph [][]int, source int) ([]float32, []int) {
+	inf := float32(math.Inf(1))
+	times := make([]float32, len(s.lines))
+	prev := make([]int, len(s.lines))
+	done := make([]bool, len(s.lines))
+	for i := range times {
+		times[i] = inf
+		prev[i] = -1
+	}
+	times[source] = travelTime(s.lines[source])
+
+	for {
+		u := -1
+		for i := range times {
+			if !done[i] && times[i] < inf && (u == -1 || times[i] < times[u]) {
+				u = i
+			}
+		}
+		if u == -1 {
+			break
+		}
+		done[u] = true
+		for _, v := range graph[u] {
+			if t := times[u] + travelTime(s.lines[v]); t < times[v] {
+				times[v] = t
+				prev[v] = u
+			}
+		}
+	}
+	return times, prev
+}
+
+// roadRoutes holds the road graph and the fastest paths found from source roads
+// during one simulation tick, so buildings next to the same road share a
+// search. Travel times only change with the loads set at the end of the tick.
+type roadRoutes struct {
+	graph [][]int
+	times map[int][]float32
+	prev  map[int][]int
+}
+
+func (s *LobbyServer) newRoadRoutes() *roadRoutes {
+	return &roadRoutes{graph: s.roadGraph(), times: make(map[int][]float32), prev: make(map[int][]int)}
+}
+
+// pathsFrom returns the shortest paths from a source road, searching them the
+// first time they are asked for.
+func (s *LobbyServer) pathsFrom(routes *roadRoutes, source int) ([]float32, []int) {
+	if _, ok := routes.times[source]; !ok {
+		routes.times[source], routes.prev[source] = s.shortestPaths(routes.graph, source)
+	}
+	return routes.times[source], routes.prev[source]
+}
+
+// nearestRoad returns the index of the closest road a building can reach, or
+// -1 if there is none.
+func (s *LobbyServer) nearestRoad(x, y float32) int {
+	p := rl.NewVector2(x, y)
+	nearest, nearestDist := -1, float32(ROAD_ACCESS_DISTANCE)
+	for i, line := range s.lines {
+		if line.Type != Road {
+			continue
+		}
+		if d := pointSegmentDistance(p, rl.NewVector2(line.StartX, line.StartY), rl.NewVector2(line.EndX, line.EndY)); d <= nearestDist {
+			nearest, nearestDist = i, d
+		}
+	}
+	return nearest
+}
+
+// updateCommutes sends the employed residents of every Residential building
+// to the workplaces, spread by the number of workers there. Each flow of
+// commuters walks, drives or takes a transit line, whichever is fastest. Cars
+// are routed over the fastest roads, using the congestion of the previous
+// update, and give the load of every road. Transit commuters wait at their
+// stops. The average commute time of every home is kept for happiness.
+func (s *LobbyServer) updateCommutes(loads []float32, routes *roadRoutes) {
+	type workplace struct {
+		index int
+		road  int
+		stops map[int]float32
+	}
+	lines := s.transitLines()
+	workplaces := make([]workplace, 0)
+	totalWorkers := 0
+	for i, b := range s.buildings {
+		if isWorkplace(b.Type) && b.Occupants > 0 {
+			workplaces = append(workplaces, workplace{i, s.nearestRoad(b.X, b.Y), s.nearbyStops(rl.NewVector2(b.X, b.Y))})
+			totalWorkers += b.Occupants
+		}
+	}
+	employmentRate := float32(0)
+	if s.workforce > 0 {
+		employmentRate = min(1, float32(s.employed)/float32(s.workforce))
+	}
+
+	for i := range s.busStops {
+		s.busStops[i].Commuters = 0
+	}
+	var modeFlows [numCommuteModes]float32
+	var totalTime, totalCommuters float32
+	for i := range s.buildings {
+		home := &s.buildings[i]
+		if home.Type != Residential {
+			continue
+		}
+		home.Commute = 0
+		commuters := float32(home.Occupants) * WORKFORCE_RATIO * employmentRate
+		if commuters == 0 || totalWorkers == 0 {
+			continue
+		}
+		homePos := rl.NewVector2(home.X, home.Y)
+		homeStops := s.nearbyStops(homePos)
+		homeRoad := s.nearestRoad(home.X, home.Y)
+		var times []float32
+		var prev []int
+		if homeRoad != -1 {
+			times, prev = s.pathsFrom(routes, homeRoad)
+		}
+
+		var commuteTime float32
+		for _, w := range workplaces {
+			work := s.buildings[w.index]
+			workPos := rl.NewVector2(work.X, work.Y)
+			flow := commuters * float32(work.Occupants) / float32(totalWorkers)
+
+			mode, best := CommuteMode(-1), float32(MAX_COMMUTE_TIME)
+			if distance := rl.Vector2Distance(homePos, workPos); distance <= MAX_WALK_DISTANCE && distance/WALK_SPEED < best {
+				mode, best = WalkCommute, distance/WALK_SPEED
+			}
+			if homeRoad != -1 && w.road != -1 && times[w.road]+PARKING_TIME < best {
+				mode, best = DriveCommute, times[w.road]+PARKING_TIME
+			}
+			transitTime, boardStop, alightStop, ok := transitTrip(lines, homeStops, w.stops)
+			if ok && transitTime < best {
+				mode, best = TransitCommute, transitTime
+			}
+
+			switch mode {
+			case DriveCommute:
+				for road := w.road; road != -1; road = prev[road] {
+					loads[road] += flow
+				}
+			case TransitCommute:
+				s.busStops[boardStop].Commuters += flow
+				s.busStops[alightStop].Commuters += flow
+			}
+			if mode != -1 {
+				modeFlows[mode] += flow
+			}
+			commuteTime += flow * best
+		}
+		home.Commute = commuteTime / commuters
+		totalTime += commuteTime
+		totalCommuters += commuters
+	}
+
+	var commuterCounts [numCommuteModes]int
+	for mode, flow := range modeFlows {
+		commuterCounts[mode] = int(math.Round(float64(flow)))
+	}
+	avgCommute := float32(0)
+	if totalCommuters > 0 {
+		avgCommute = totalTime / totalCommuters
+	}
+	if commuterCounts != s.commuters || avgCommute != s.avgCommute {
+		s.commuters, s.avgCommute = commuterCounts, avgCommute
+		s.broadcastToAll(s.commuteMessage())
+	}
+}
+
+// transitStop is a stop on a transit line, with its distance along the line.
+type transitStop struct {
+	stop     int
+	distance float32
+}
+
+type transitLine struct {
+	stops  []transitStop
+	length float32
+	loop   bool
+	speed  float32
+}
+
+// transitLines reduces every transit route to its stops, once per update.
+func (s *LobbyServer) transitLines() []transitLine {
+	lines := make([]transitLine, 0, len(s.busRoutes))
+	for _, route := range s.busRoutes {
+		line := transitLine{length: route.Length, loop: route.Loop, speed: getTransitSpeed(route.Mode)}
+		nodes := routeNodes(route)
+		var distance float32
+		for j, node := range nodes {
+			if j > 0 {
+				distance += rl.Vector2Distance(nodes[j-1], node)
+			}
+			if stop := s.stopAt(node.X, node.Y); stop != -1 {
+				line.stops = append(line.stops, transitStop{stop, distance})
+			}
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// nearbyStops returns the walking distance to every stop within the catchment
+// of a position.
+func (s *LobbyServer) nearbyStops(p rl.Vector2) map[int]float32 {
+	stops := make(map[int]float32)
+	for i, stop := range s.busStops {
+		if d := rl.Vector2Distance(p, rl.NewVector2(stop.X, stop.Y)); d <= STOP_CATCHMENT_RADIUS {
+			stops[i] = d
+		}
+	}
+	return stops
+}
+
+// transitTrip finds the fastest trip between two places on a single transit
+// line, walking to and from the stops near them. It returns the travel time
+// and the stops used, or false if no line connects them.
+func transitTrip(lines []transitLine, fromStops, toStops map[int]float32) (float32, int, int, bool) {
+	best, bestBoard, bestAlight, found := float32(0), -1, -1, false
+	if len(fromStops) == 0 || len(toStops) == 0 {
+		return best, bestBoard, bestAlight, found
+	}
+	for _, line := range lines {
+		for i, a := range line.stops {
+			walkTo, ok := fromStops[a.stop]
+			if !ok {
+				continue
+			}
+			for j, b := range line.stops {
+				walkFrom, ok := toStops[b.stop]
+				if i == j || !ok {
+					continue
+				}
+				ride := b.distance - a.distance
+				if ride < 0 && line.loop {
+					ride += line.length
+				}
+				t := (walkTo+walkFrom)/WALK_SPEED + TRANSIT_WAIT_TIME + float32(math.Abs(float64(ride)))/line.speed
+				if !found || t < best {
+					best, bestBoard, bestAlight, found = t, a.stop, b.stop, true
+				}
+			}
+		}
+	}
+	return best, bestBoard, bestAlight, found
+}
+
+func (s *LobbyServer) commuteMessage() string {
+	return fmt.Sprintf("COMMUTE:%d:%d:%d:%.1f", s.commuters[WalkCommute], s.commuters[DriveCommute], s.commuters[TransitCommute], s.avgCommute)
+}
+
+// cellIndex returns the index of the grid cell containing a point, or false if
+// the point lies outside the map.
+func cellIndex(x, y float32) (int, bool) {
+	cx, cy := int(math.Floor(float64(x/GRID_SIZE))), int(math.Floor(float64(y/GRID_SIZE)))
+	if cx < 0 || cy < 0 || cx >= GRID_CELLS || cy >= GRID_CELLS {
+		return 0, false
+	}
+	return cy*GRID_CELLS + cx, true
+}
+
+func (s *LobbyServer) heatmapAt(kind HeatmapKind, x, y float32) float32 {
+	if cell, ok := cellIndex(x, y); ok {
+		return s.heatmaps[kind][cell]
+	}
+	return 0
+}
+
+// diffuse adds the emissions to what is left of a field after decay and then
+// spreads every cell towards the average of its neighbours.
+func diffuse(field, emissions []float32, decay float32, iterations int) []float32 {
+	next := make([]float32, len(field))
+	for i := range field {
+		next[i] = field[i]*decay + emissions[i]
+	}
+	for it := 0; it < iterations; it++ {
+		spread := make([]float32, len(next))
+		for i := range next {
+			cx, cy := i%GRID_CELLS, i/GRID_CELLS
+			var sum float32
+			var count float32
+			for _, d := range [4][2]int{{1, 0}, {-1, 0}, {0, 1}, {0, -1}} {
+				nx, ny := cx+d[0], cy+d[1]
+				if nx >= 0 && ny >= 0 && nx < GRID_CELLS && ny < GRID_CELLS {
+					sum += next[ny*GRID_CELLS+nx]
+					count++
+				}
+			}
+			spread[i] = (1-POLLUTION_SPREAD)*next[i] + POLLUTION_SPREAD*sum/count
+		}
+		next = spread
+	}
+	return next
+}
+
+// updatePollution lets working Industrial buildings and busy roads emit
+// ground pollution and noise and spreads both over the grid. Ground pollution
+// builds up over time while noise only lasts as long as its source.
+func (s *LobbyServer) updatePollution() {
+	ground := make([]float32, GRID_CELLS*GRID_CELLS)
+	noise := make([]float32, GRID_CELLS*GRID_CELLS)
+	for _, b := range s.buildings {
+		if b.Type != Industrial || b.Occupants == 0 {
+			continue
+		}
+		if cell, ok := cellIndex(b.X, b.Y); ok {
+			activity := float32(b.Occupants) / float32(b.Capacity)
+			ground[cell] += INDUSTRIAL_POLLUTION * activity
+			noise[cell] += INDUSTRIAL_NOISE * activity
+		}
+	}
+	for _, line := range s.lines {
+		if line.Type != Road || line.Load == 0 || line.Crossing == Tunnel {
+			continue
+		}
+		start, end := rl.NewVector2(line.StartX, line.StartY), rl.NewVector2(line.EndX, line.EndY)
+		samples := int(rl.Vector2Distance(start, end)/GRID_SIZE) + 1
+		for k := 0; k <= samples; k++ {
+			p := rl.Vector2Lerp(start, end, float32(k)/float32(samples))
+			if cell, ok := cellIndex(p.X, p.Y); ok {
+				ground[cell] += line.Load * ROAD_POLLUTION_PER_VEHICLE / float32(samples+1)
+				noise[cell] += line.Load * ROAD_NOISE_PER_VEHICLE / float32(samples+1)
+			}
+		}
+	}
+
+	s.heatmaps[PollutionHeatmap] = diffuse(s.heatmaps[PollutionHeatmap], ground, POLLUTION_DECAY, 3)
+	s.heatmaps[NoiseHeatmap] = diffuse(s.heatmaps[NoiseHeatmap], noise, 0, 2)
+	s.broadcastHeatmap(PollutionHeatmap)
+	s.broadcastHeatmap(NoiseHeatmap)
+}
+
+// spreadInfluence raises every cell within the radius of a position to the
+// amount, falling off linearly with the distance. Overlapping sources don't
+// add up.
+func spreadInfluence(field []float32, pos rl.Vector2, radius, amount float32) {
+	cells := int(radius/GRID_SIZE) + 1
+	cx, cy := int(pos.X/GRID_SIZE), int(pos.Y/GRID_SIZE)
+	for y := cy - cells; y <= cy+cells; y++ {
+		for x := cx - cells; x <= cx+cells; x++ {
+			if x < 0 || y < 0 || x >= GRID_CELLS || y >= GRID_CELLS {
+				continue
+			}
+			center := rl.NewVector2((float32(x)+0.5)*GRID_SIZE, (float32(y)+0.5)*GRID_SIZE)
+			if d := rl.Vector2Distance(center, pos); d <= radius {
+				field[y*GRID_CELLS+x] = max(field[y*GRID_CELLS+x], amount*(1-d/radius))
+			}
+		}
+	}
+}
+
+// spreadAlongLine applies spreadInfluence at points along a line.
+func spreadAlongLine(field []float32, line StoredLine, radius, amount float32) {
+	start, end := rl.NewVector2(line.StartX, line.StartY), rl.NewVector2(line.EndX, line.EndY)
+	samples := int(rl.Vector2Distance(start, end)/(GRID_SIZE/2)) + 1
+	for k := 0; k <= samples; k++ {
+		spreadInfluence(field, rl.Vector2Lerp(start, end, float32(k)/float32(samples)), radius, amount)
+	}
+}
+
+// updateCoverage spreads every service building with road access over the
+// cells within its radius. Coverage is full up to half the radius and fades out
+// beyond.
+func (s *LobbyServer) updateCoverage() {
+	for kind := PoliceHeatmap; kind <= EducationHeatmap; kind++ {
+		clear(s.heatmaps[kind])
+	}
+	for _, b := range s.buildings {
+		if isServiceType(b.Type) && b.Connected {
+			spreadInfluence(s.heatmaps[getServiceHeatmap(b.Type)], rl.NewVector2(b.X, b.Y), getServiceRadius(b.Type), 2*MAX_COVERAGE)
+		}
+	}
+	for kind := PoliceHeatmap; kind <= EducationHeatmap; kind++ {
+		for i, v := range s.heatmaps[kind] {
+			s.heatmaps[kind][i] = min(MAX_COVERAGE, v)
+		}
+		s.broadcastHeatmap(kind)
+	}
+}
+
+// cellCoverage returns the average coverage of a cell by all services, from 0
+// to 1.
+func (s *LobbyServer) cellCoverage(cell int) float32 {
+	var total float32
+	for kind := PoliceHeatmap; kind <= EducationHeatmap; kind++ {
+		total += s.heatmaps[kind][cell]
+	}
+	return total / (MAX_COVERAGE * float32(EducationHeatmap-PoliceHeatmap+1))
+}
+
+func (s *LobbyServer) serviceCoverage(x, y float32) float32 {
+	if cell, ok := cellIndex(x, y); ok {
+		return s.cellCoverage(cell)
+	}
+	return 0
+}
+
+// updateLandValue computes the value of every cell from its access to roads,
+// the view on rivers, nearby transit stops, parks and city services, minus
+// pollution and noise.
+func (s *LobbyServer) updateLandValue() {
+	roads := make([]float32, GRID_CELLS*GRID_CELLS)
+	water := make([]float32, GRID_CELLS*GRID_CELLS)
+	transit := make([]float32, GRID_CELLS*GRID_CELLS)
+	clear(s.decorations)
+	for _, line := range s.lines {
+		switch {
+		case line.Type == Road && line.Crossing != Tunnel:
+			spreadAlongLine(roads, line, ROAD_LAND_VALUE_RADIUS, ROAD_LAND_VALUE)
+		case line.Type == Water:
+			spreadAlongLine(water, line, WATER_LAND_VALUE_RADIUS, WATER_LAND_VALUE)
+		}
+	}
+	for _, stop := range s.busStops {
+		if s.isRouteNode(stop.X, stop.Y) {
+			spreadInfluence(transit, rl.NewVector2(stop.X, stop.Y), STOP_CATCHMENT_RADIUS, TRANSIT_LAND_VALUE)
+		}
+	}
+	for _, b := range s.buildings {
+		if radius, strength := getDecorationEffect(b.Type); radius > 0 {
+			spreadInfluence(s.decorations, rl.NewVector2(b.X, b.Y), radius, strength)
+		}
+	}
+
+	landValue := s.heatmaps[LandValueHeatmap]
+	for i := range landValue {
+		value := roads[i] + water[i] + transit[i] + DECORATION_LAND_VALUE*s.decorations[i] + SERVICE_LAND_VALUE*s.cellCoverage(i)
+		value -= POLLUTION_LAND_VALUE * min(1, s.heatmaps[PollutionHeatmap][i]/POLLUTION_SCALE)
+		value -= NOISE_LAND_VALUE * min(1, s.heatmaps[NoiseHeatmap][i]/POLLUTION_SCALE)
+		landValue[i] = max(0, min(MAX_LAND_VALUE, value))
+	}
+	s.broadcastHeatmap(LandValueHeatmap)
+}
+
+// pickByLandValue picks a random zone, preferring zones on valuable land.
+func (s *LobbyServer) pickByLandValue(zones []StoredZone) int {
+	weights := make([]float32, len(zones))
+	var total float32
+	for i, z := range zones {
+		weights[i] = 1 + s.heatmapAt(LandValueHeatmap, z.X, z.Y)
+		total += weights[i]
+	}
+	r := rand.Float32() * total
+	for i, w := range weights {
+		if r < w {
+			return i
+		}
+		r -= w
+	}
+	return len(zones) - 1
+}
+
+// updateHappiness rates every Residential building from 0 to 1. Pollution,
+// noise, long commutes, missing city services and high taxes make residents
+// unhappy, valuable land and parks, plazas and trees nearby cheer them up, and
+// unhappy buildings don't fill up completely. The city rating is the happiness
+// of the average resident.
+func (s *LobbyServer) updateHappiness() {
+	var total float32
+	residents := 0
+	for i := range s.buildings {
+		b := &s.buildings[i]
+		if b.Type != Residential {
+			continue
+		}
+		happiness := float32(1)
+		happiness -= TAX_HAPPINESS_PENALTY * float32(s.taxRate) / MAX_TAX_RATE
+		happiness += LAND_VALUE_HAPPINESS_BONUS * s.heatmapAt(LandValueHeatmap, b.X, b.Y) / MAX_LAND_VALUE
+		happiness -= POLLUTION_HAPPINESS_PENALTY * min(1, s.heatmapAt(PollutionHeatmap, b.X, b.Y)/POLLUTION_SCALE)
+		happiness -= NOISE_HAPPINESS_PENALTY * min(1, s.heatmapAt(NoiseHeatmap, b.X, b.Y)/POLLUTION_SCALE)
+		happiness -= COMMUTE_HAPPINESS_PENALTY * min(1, b.Commute/MAX_COMMUTE_TIME)
+		happiness -= SERVICE_HAPPINESS_PENALTY * (1 - s.serviceCoverage(b.X, b.Y))
+		happiness += DECORATION_HAPPINESS_BONUS * s.decorationBonus(b.X, b.Y)
+		happiness = max(0, min(1, happiness))
+
+		changed := int(happiness*100) != int(b.Happiness*100)
+		b.Happiness = happiness
+		if changed {
+			s.broadcastToAll(buildingStatusMessage(i, *b))
+		}
+		total += happiness * float32(b.Occupants)
+		residents += b.Occupants
+	}
+
+	rating := float32(0)
+	if residents > 0 {
+		rating = total / float32(residents)
+	}
+	if int(rating*100) != int(s.rating*100) {
+		s.rating = rating
+		s.broadcastToAll(s.ratingMessage())
+	}
+}
+
+// isNeglected reports whether a zoned building is missing something it needs:
+// a road connection, power and water, goods for workplaces and happy residents
+// for homes.
+func isNeglected(b StoredBuilding) bool {
+	switch {
+	case !b.Connected || !b.Powered || !b.Watered:
+		return true
+	case isWorkplace(b.Type):
+		return b.Occupants > 0 && b.Supply < MIN_HEALTHY_SUPPLY
+	case b.Type == Residential:
+		return b.Happiness < MOVE_OUT_HAPPINESS
+	default:
+		return false
+	}
+}
+
+// updateDecay abandons zoned buildings that have been neglected for too long
+// and lets abandoned buildings fall apart until they collapse, freeing their
+// lot for new buildings.
+func (s *LobbyServer) updateDecay() {
+	collapsed := false
+	for i := len(s.buildings) - 1; i >= 0; i-- {
+		b := &s.buildings[i]
+		if !isZoneType(b.Type) {
+			continue
+		}
+		if b.Abandoned {
+			b.Decay++
+			if b.Decay >= COLLAPSE_AFTER_TICKS {
+				s.buildings = append(s.buildings[:i], s.buildings[i+1:]...)
+				collapsed = true
+				continue
+			}
+			s.broadcastToAll(buildingStatusMessage(i, *b))
+			continue
+		}
+		if !isNeglected(*b) {
+			b.Neglect = 0
+			continue
+		}
+		b.Neglect++
+		if b.Neglect >= ABANDON_AFTER_TICKS {
+			b.Abandoned = true
+			b.Occupants = 0
+			s.broadcastToAll(buildingStatusMessage(i, *b))
+		}
+	}
+
+	if collapsed {
+		s.updateConnectivity()
+		s.broadcastFullState()
+	}
+}
+
+func (s *LobbyServer) ratingMessage() string {
+	return fmt.Sprintf("RATING:%d", int(s.rating*100))
+}
+
+func (s *LobbyServer) taxRateMessage() string {
+	return fmt.Sprintf("TAXRATE:%d", s.taxRate)
+}
+
+// setTaxRate changes the tax rate, in percent, of the whole city. Higher taxes
+// bring in more money but make residents unhappy.
+func (s *LobbyServer) setTaxRate(parts []string) {
+	playerID := parts[1]
+	rate, err := strconv.Atoi(parts[2])
+	if err != nil || rate < 0 || rate > MAX_TAX_RATE {
+		s.broadcastToPlayer(playerID, fmt.Sprintf("STATUS:The tax rate must be between 0 and %d%%!", MAX_TAX_RATE))
+		return
+	}
+	if rate == s.taxRate {
+		return
+	}
+	s.taxRate = rate
+	s.broadcastToAll(s.taxRateMessage())
+	s.updateIncome()
+}
+
+// broadcastHeatmap sends a heatmap to the clients if it changed since it was
+// last sent.
+func (s *LobbyServer) broadcastHeatmap(kind HeatmapKind) {
+	msg := s.heatmapMessage(kind)
+	if msg != s.sentHeat[kind] {
+		s.sentHeat[kind] = msg
+		s.broadcastToAll(msg)
+	}
+}
+
+// heatmapMessage lists the cells of a heatmap with a noticeable value as
+// cell=value pairs.
+func (s *LobbyServer) heatmapMessage(kind HeatmapKind) string {
+	cells := make([]string, 0)
+	for i, v := range s.heatmaps[kind] {
+		if v >= 1 {
+			cells = append(cells, fmt.Sprintf("%d=%.0f", i, v))
+		}
+	}
+	return fmt.Sprintf("HEAT:%d:%s", kind, strings.Join(cells, ","))
+}
+
+// setTraffic stores the number of vehicles on every road and sends the
+// congestion to the clients.
+func (s *LobbyServer) setTraffic(loads []float32) {
+	for i := range s.lines {
+		s.lines[i].Load = loads[i]
+	}
+	s.broadcastToAll(s.trafficMessage())
+}
+
+// updateGoods lets Industrial buildings produce goods and delivers them by
+// truck to the Commercial buildings, nearest producer first. Goods nobody in
+// the city buys are exported over a road at the map edge for less money. The
+// supply of a Commercial building is the share of its demand it received, the
+// supply of an Industrial building the share of its goods it sold. Trucks add
+// to the road loads.
+func (s *LobbyServer) updateGoods(loads []float32, routes *roadRoutes) {
+	type producer struct {
+		index int
+		road  int
+		stock float32
+		sold  float32
+		times []float32
+		prev  []int
+	}
+	producers := make([]*producer, 0)
+	var produced, delivered, exported float32
+	for i, b := range s.buildings {
+		if b.Type != Industrial || !b.Connected || !b.Powered || b.Occupants == 0 {
+			continue
+		}
+		p := &producer{index: i, road: s.nearestRoad(b.X, b.Y), stock: float32(b.Occupants) * GOODS_PER_WORKER}
+		if p.road != -1 {
+			p.times, p.prev = s.pathsFrom(routes, p.road)
+		}
+		producers = append(producers, p)
+		produced += p.stock
+	}
+
+	deliver := func(p *producer, destRoad int, to rl.Vector2, amount float32) {
+		for road := destRoad; road != -1; road = p.prev[road] {
+			loads[road] += amount / GOODS_PER_TRUCK
+		}
+		if len(s.trucks) < MAX_TRUCKS {
+			from := s.buildings[p.index]
+			path := s.roadPath(p.prev, destRoad, rl.NewVector2(from.X, from.Y), to)
+			s.trucks = append(s.trucks, Truck{Path: path, Position: path[0]})
+		}
+	}
+
+	for i := range s.buildings {
+		shop := &s.buildings[i]
+		if shop.Type != Commercial {
+			continue
+		}
+		demand := float32(shop.Occupants) * GOODS_DEMAND_PER_WORKER
+		received := float32(0)
+		shopRoad := s.nearestRoad(shop.X, shop.Y)
+		for shopRoad != -1 && received < demand {
+			var best *producer
+			for _, p := range producers {
+				if p.stock > 0 && p.road != -1 && !math.IsInf(float64(p.times[shopRoad]), 1) && (best == nil || p.times[shopRoad] < best.times[shopRoad]) {
+					best = p
+				}
+			}
+			if best == nil {
+				break
+			}
+			amount := min(best.stock, demand-received)
+			best.stock -= amount
+			best.sold += amount
+			received += amount
+			deliver(best, shopRoad, rl.NewVector2(shop.X, shop.Y), amount)
+		}
+		delivered += received
+		supply := float32(0)
+		if demand > 0 {
+			supply = received / demand
+		}
+		s.setSupply(i, supply)
+	}
+
+	edgeRoads := make([]int, 0)
+	for i, line := range s.lines {
+		if line.Type == Road && (isAtMapEdge(rl.NewVector2(line.StartX, line.StartY)) || isAtMapEdge(rl.NewVector2(line.EndX, line.EndY))) {
+			edgeRoads = append(edgeRoads, i)
+		}
+	}
+	producing := make(map[int]bool)
+	for _, p := range producers {
+		producing[p.index] = true
+	}
+	for i, b := range s.buildings {
+		if b.Type == Industrial && !producing[i] {
+			s.setSupply(i, 0)
+		}
+	}
+	for _, p := range producers {
+		output := p.stock + p.sold
+		if p.stock > 0 && p.road != -1 {
+			exit := -1
+			for _, road := range edgeRoads {
+				if !math.IsInf(float64(p.times[road]), 1) && (exit == -1 || p.times[road] < p.times[exit]) {
+					exit = road
+				}
+			}
+			if exit != -1 {
+				line := s.lines[exit]
+				edge := rl.NewVector2(line.StartX, line.StartY)
+				if !isAtMapEdge(edge) {
+					edge = rl.NewVector2(line.EndX, line.EndY)
+				}
+				deliver(p, exit, edge, p.stock)
+				p.sold += p.stock * EXPORT_INCOME_FACTOR
+				exported += p.stock
+			}
+		}
+		s.setSupply(p.index, p.sold/output)
+	}
+
+	if goods := [3]float32{produced, delivered, exported}; goods != s.goods {
+		s.goods = goods
+		s.broadcastToAll(s.goodsMessage())
+	}
+}
+
+func (s *LobbyServer) setSupply(index int, supply float32) {
+	b := &s.buildings[index]
+	changed := int(supply*100) != int(b.Supply*100)
+	b.Supply = supply
+	if changed {
+		s.broadcastToAll(buildingStatusMessage(index, *b))
+	}
+}
+
+func (s *LobbyServer) goodsMessage() string {
+	return fmt.Sprintf("GOODS:%.0f:%.0f:%.0f", s.goods[0], s.goods[1], s.goods[2])
+}
+
+// roadPath turns the roads leading to destRoad into points a vehicle can
+// drive along, from the road next to one place to the road next to another.
+func (s *LobbyServer) roadPath(prev []int, destRoad int, from, to rl.Vector2) []rl.Vector2 {
+	roads := make([]int, 0)
+	for road := destRoad; road != -1; road = prev[road] {
+		roads = append([]int{road}, roads...)
+	}
+	first, last := s.lines[roads[0]], s.lines[roads[len(roads)-1]]
+	path := []rl.Vector2{closestPointOnSegment(from, rl.NewVector2(first.StartX, first.StartY), rl.NewVector2(first.EndX, first.EndY))}
+	for k := 1; k < len(roads); k++ {
+		path = append(path, touchPoint(s.lines[roads[k-1]], s.lines[roads[k]]))
+	}
+	return append(path, closestPointOnSegment(to, rl.NewVector2(last.StartX, last.StartY), rl.NewVector2(last.EndX, last.EndY)))
+}
+
+// moveTrucks drives every truck along its path at the speed of the road it is
+// on and removes it once it has arrived.
+func (s *LobbyServer) moveTrucks(frameTime float32) {
+	if len(s.trucks) == 0 {
+		return
+	}
+	remaining := s.trucks[:0]
+	for _, truck := range s.trucks {
+		next := min(truck.Segment+1, len(truck.Path)-1)
+		speed := s.roadSpeedAt(truck.Position, truck.Path[truck.Segment], truck.Path[next])
+		if speed == 0 {
+			speed = STREET_SPEED
+		}
+		step := speed * frameTime
+		for step > 0 && truck.Segment < len(truck.Path)-1 {
+			segmentEnd := truck.Path[truck.Segment+1]
+			distance := rl.Vector2Distance(truck.Position, segmentEnd)
+			if distance > step {
+				truck.Position = rl.Vector2MoveTowards(truck.Position, segmentEnd, step)
+				break
+			}
+			truck.Position = segmentEnd
+			truck.Segment++
+			step -= distance
+		}
+		if truck.Segment < len(truck.Path)-1 {
+			remaining = append(remaining, truck)
+		}
+	}
+	s.trucks = remaining
+	s.broadcastToAll(s.trucksMessage())
+}
+
+func (s *LobbyServer) trucksMessage() string {
+	positions := make([]string, len(s.trucks))
+	for i, truck := range s.trucks {
+		positions[i] = fmt.Sprintf("%.0f,%.0f", truck.Position.X, truck.Position.Y)
+	}
+	return "TRUCKS:" + strings.Join(positions, ";")
+}
+
+// trafficMessage lists the load of every line relative to its capacity, in
+// the same order as the lines.
+func (s *LobbyServer) trafficMessage() string {
+	ratios := make([]string, len(s.lines))
+	for i, line := range s.lines {
+		ratio := float32(0)
+		if line.Type == Road {
+			ratio = line.Load / float32(getRoadCapacity(line.Class))
+		}
+		ratios[i] = fmt.Sprintf("%.2f", ratio)
+	}
+	return "TRAFFIC:" + strings.Join(ratios, ",")
+}
+
+func (s *LobbyServer) isNearRiver(x, y float32, distance float32) bool {
+	p := rl.NewVector2(x, y)
+	for _, line := range s.lines {
+		if line.Type != Water {
+			continue
+		}
+		if pointSegmentDistance(p, rl.NewVector2(line.StartX, line.StartY), rl.NewVector2(line.EndX, line.EndY)) <= distance {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *LobbyServer) addBuilding(msg string, parts []string) {
+	playerID := parts[1]
+	x, _ := strconv.ParseFloat(parts[2], 32)
+	y, _ := strconv.ParseFloat(parts[3], 32)
+	buildingTypeInt, _ := strconv.Atoi(parts[4])
+	buildingType := BuildingType(buildingTypeInt)
+
+	var cost float32
+
+	switch buildingType {
+	case Residential:
+		cost = RESIDENTIAL_BUILDING_COST
+	case Commercial:
+		cost = COMMERCIAL_BUILDING_COST
+	case Industrial:
+		cost = INDUSTRIAL_BUILDING_COST
+	case WaterPump:
+		cost = WATER_PUMP_COST
+		if !s.isNearRiver(float32(x), float32(y), PUMP_RIVER_DISTANCE) {
+			s.broadcastToPlayer(playerID, "STATUS:Water pumps must be placed next to a river!")
+			return
+		}
+	case PowerPlant:
+		cost = POWER_PLANT_COST
+	case PoliceStation, FireStation, Clinic, School, Park, Plaza, Tree:
+		cost = getBuildingCost(buildingType)
+	default:
+		s.broadcastToPlayer(playerID, "STATUS:Unknown building type!")
+		return
+	}
+
+	if !isOnMap(rl.NewVector2(float32(x), float32(y))) {
+		s.broadcastToPlayer(playerID, "STATUS:Buildings must be placed on the map!")
+		return
+	}
+	if s.isNearRiver(float32(x), float32(y), RIVER_HALF_WIDTH) {
+		s.broadcastToPlayer(playerID, "STATUS:Buildings can't be placed on a river!")
+		return
+	}
+
+	if s.money < cost {
+		s.broadcastToPlayer(playerID, fmt.Sprintf("STATUS:Not enough money to build %s! Cost: %.2f", getBuildingName(buildingType), cost))
+		return
+	}
+
+	s.money -= cost
+	s.broadcastMoney()
+
+	// Happiness starts full so updatePopulation doesn't empty new homes
+	// before updateHappiness has rated them.
+	newBuilding := StoredBuilding{
+		X: float32(x), Y: float32(y),
+		Type: buildingType, PlayerID: playerID,
+		Capacity: getBuildingCapacity(buildingType), Level: 1, Happiness: 1,
+	}
+	s.buildings = append(s.buildings, newBuilding)
+	s.broadcastToAll(msg)
+	s.updateConnectivity()
+}
+
+// getUpgradeCost returns the price of raising a building from the given level
+// to the next one. Every level costs more than the one before.
+func getUpgradeCost(buildingType BuildingType, level int) float32 {
+	return getBuildingCost(buildingType) * UPGRADE_COST_MULTIPLIER * float32(level)
+}
+
+// upgradeBuilding raises a connected zoned building to the next density
+// level, adding room for more residents or jobs.
+func (s *LobbyServer) upgradeBuilding(parts []string) {
+	playerID := parts[1]
+	x, _ := strconv.ParseFloat(parts[2], 32)
+	y, _ := strconv.ParseFloat(parts[3], 32)
+	index := s.buildingAt(float32(x), float32(y))
+	if index == -1 || !isZoneType(s.buildings[index].Type) {
+		s.broadcastToPlayer(playerID, "STATUS:Only residential, commercial and industrial buildings can be upgraded!")
+		return
+	}
+
+	b := &s.buildings[index]
+	switch {
+	case b.Abandoned:
+		s.broadcastToPlayer(playerID, "STATUS:Abandoned buildings can't be upgraded!")
+		return
+	case !b.Connected:
+		s.broadcastToPlayer(playerID, "STATUS:Only connected buildings can be upgraded!")
+		return
+	case b.Level >= MAX_BUILDING_LEVEL:
+		s.broadcastToPlayer(playerID, "STATUS:This building is already at the highest level!")
+		return
+	}
+
+	cost := getUpgradeCost(b.Type, b.Level)
+	if s.money < cost {
+		s.broadcastToPlayer(playerID, fmt.Sprintf("STATUS:Not enough money to upgrade %s! Cost: %.2f", getBuildingName(b.Type), cost))
+		return
+	}
+
+	s.money -= cost
+	s.broadcastMoney()
+	b.Level++
+	b.Capacity = getBuildingCapacity(b.Type) * b.Level
+	s.broadcastToAll(buildingStatusMessage(index, *b))
+	s.updateConnectivity()
+}
+
+func (s *LobbyServer) buildingAt(x, y float32) int {
+	for i, b := range s.buildings {
+		if b.X == x && b.Y == y {
+			return i
+		}
+	}
+	return -1
+}
+
+func (s *LobbyServer) zoneAt(x, y float32) int {
+	for i, z := range s.zones {
+		if z.X == x && z.Y == y {
+			return i
+		}
+	}
+	return -1
+}
+
+// setZones paints (or clears) zones on every cell in the dragged rectangle.
+// Only cells next to a road that are not covered by a road themselves can be
+// zoned.
+func (s *LobbyServer) setZones(parts []string) {
+	playerID := parts[1]
+	startX, _ := strconv.ParseFloat(parts[2], 32)
+	startY, _ := strconv.ParseFloat(parts[3], 32)
+	endX, _ := strconv.ParseFloat(parts[4], 32)
+	endY, _ := strconv.ParseFloat(parts[5], 32)
+	zoneTypeInt, _ := strconv.Atoi(parts[6])
+	zoneType := BuildingType(zoneTypeInt)
+
+	if zoneType != NoZone && zoneType != Residential && zoneType != Commercial && zoneType != Industrial {
+		s.broadcastToPlayer(playerID, "STATUS:Unknown zone type!")
+		return
+	}
+
+	minX, maxX := float32(math.Min(startX, endX)), float32(math.Max(startX, endX))
+	minY, maxY := float32(math.Min(startY, endY)), float32(math.Max(startY, endY))
+	cellsX := int((maxX-minX)/GRID_SIZE) + 1
+	cellsY := int((maxY-minY)/GRID_SIZE) + 1
+	if cellsX*cellsY > MAX_ZONE_CELLS {
+		s.broadcastToPlayer(playerID, "STATUS:Zone area is too large!")
+		return
+	}
+
+	changed := false
+	for cx := 0; cx < cellsX; cx++ {
+		for cy := 0; cy < cellsY; cy++ {
+			x := minX + float32(cx*GRID_SIZE)
+			y := minY + float32(cy*GRID_SIZE)
+			idx := s.zoneAt(x, y)
+
+			if zoneType == NoZone {
+				if idx != -1 {
+					removed := s.zones[idx]
+					s.zones = append(s.zones[:idx], s.zones[idx+1:]...)
+					removed.Type = NoZone
+					s.broadcastToAll(zoneMessage(removed))
+					changed = true
+				}
+				continue
+			}
+
+			if !isOnMap(rl.NewVector2(x, y)) || s.isPointOnRoad(x, y) || !s.isNearRoad(x, y) {
+				continue
+			}
+			if idx != -1 {
+				if s.zones[idx].Type == zoneType {
+					continue
+				}
+				s.zones[idx].Type = zoneType
+				s.zones[idx].PlayerID = playerID
+				s.broadcastToAll(zoneMessage(s.zones[idx]))
+			} else {
+				newZone := StoredZone{X: x, Y: y, Type: zoneType, PlayerID: playerID}
+				s.zones = append(s.zones, newZone)
+				s.broadcastToAll(zoneMessage(newZone))
+			}
+			changed = true
+		}
+	}
+
+	if !changed {
+		s.broadcastToPlayer(playerID, "STATUS:No cells along a road to zone here.")
+	}
+}
+
+func (s *LobbyServer) isNearRoad(x, y float32) bool {
+	p := rl.NewVector2(x, y)
+	for _, line := range s.lines {
+		if line.Type != Road {
+			continue
+		}
+		if pointSegmentDistance(p, rl.NewVector2(line.StartX, line.StartY), rl.NewVector2(line.EndX, line.EndY)) <= ROAD_ACCESS_DISTANCE {
+			return true
+		}
+	}
+	return false
+}
+
+// growZones builds new buildings on empty zoned cells with road access. The
+// number of buildings per zone type grows with its demand, as long as the city
+// can pay for them.
+func (s *LobbyServer) growZones() {
+	grew := false
+	for _, zoneType := range []BuildingType{Residential, Commercial, Industrial} {
+		if s.demand[zoneType] <= 0 {
+			continue
+		}
+		cost := getBuildingCost(zoneType)
+
+		candidates := make([]StoredZone, 0)
+		for _, z := range s.zones {
+			if z.Type == zoneType && s.buildingAt(z.X, z.Y) == -1 && !s.isPointOnRoad(z.X, z.Y) && s.isNearRoad(z.X, z.Y) && !s.isNearRiver(z.X, z.Y, RIVER_HALF_WIDTH) {
+				candidates = append(candidates, z)
+			}
+		}
+
+		growth := int(math.Ceil(float64(s.demand[zoneType] * MAX_ZONE_GROWTH_PER_TICK)))
+		for n := 0; n < growth && len(candidates) > 0 && s.money >= cost; n++ {
+			pick := s.pickByLandValue(candidates)
+			z := candidates[pick]
+			candidates = append(candidates[:pick], candidates[pick+1:]...)
+
+			s.money -= cost
+			newBuilding := StoredBuilding{X: z.X, Y: z.Y, Type: zoneType, PlayerID: z.PlayerID, Capacity: getBuildingCapacity(zoneType), Level: 1, Happiness: 1}
+			s.buildings = append(s.buildings, newBuilding)
+			s.broadcastToAll(fmt.Sprintf("B:%s:%.0f:%.0f:%d", newBuilding.PlayerID, newBuilding.X, newBuilding.Y, int(newBuilding.Type)))
+			grew = true
+		}
+	}
+
+	if grew {
+		s.broadcastMoney()
+		s.updateConnectivity()
+	}
+}
+
+func zoneMessage(z StoredZone) string {
+	return fmt.Sprintf("ZONE:%s:%.0f:%.0f:%d", z.PlayerID, z.X, z.Y, int(z.Type))
+}
+
+func getBuildingCost(buildingType BuildingType) float32 {
+	switch buildingType {
+	case Residential:
+		return RESIDENTIAL_BUILDING_COST
+	case Commercial:
+		return COMMERCIAL_BUILDING_COST
+	case Industrial:
+		return INDUSTRIAL_BUILDING_COST
+	case WaterPump:
+		return WATER_PUMP_COST
+	case PowerPlant:
+		return POWER_PLANT_COST
+	case PoliceStation:
+		return POLICE_STATION_COST
+	case FireStation:
+		return FIRE_STATION_COST
+	case Clinic:
+		return CLINIC_COST
+	case School:
+		return SCHOOL_COST
+	case Park:
+		return PARK_COST
+	case Plaza:
+		return PLAZA_COST
+	case Tree:
+		return TREE_COST
+	default:
+		return 0
+	}
+}
+
+func getTransitSpeed(mode TransitMode) float32 {
+	switch mode {
+	case TramTransit:
+		return TRAM_SPEED
+	case MetroTransit:
+		return METRO_SPEED
+	default:
+		return BUS_SPEED
+	}
+}
+
+func getTransitCapacity(mode TransitMode) int {
+	switch mode {
+	case TramTransit:
+		return TRAM_CAPACITY
+	case MetroTransit:
+		return METRO_CAPACITY
+	default:
+		return BUS_CAPACITY
+	}
+}
+
+func getTransitVehicleCost(mode TransitMode) float32 {
+	switch mode {
+	case TramTransit:
+		return TRAM_PURCHASE_COST
+	case MetroTransit:
+		return METRO_PURCHASE_COST
+	default:
+		return BUS_PURCHASE_COST
+	}
+}
+
+func getTransitOperatingCost(mode TransitMode) float32 {
+	switch mode {
+	case TramTransit:
+		return TRAM_OPERATING_COST
+	case MetroTransit:
+		return METRO_OPERATING_COST
+	default:
+		return BUS_OPERATING_COST
+	}
+}
+
+// getTransitTrackCost is the build cost per unit of route length. Buses use
+// the existing roads for free.
+func getTransitTrackCost(mode TransitMode) float32 {
+	switch mode {
+	case TramTransit:
+		return TRAM_TRACK_COST_PER_UNIT
+	case MetroTransit:
+		return METRO_TUNNEL_COST_PER_UNIT
+	default:
+		return 0
+	}
+}
+
+func (s *LobbyServer) addBusRoute(msg string, parts []string) {
+	playerID := parts[1]
+	loop := parts[2] == "1"
+	mode, err := strconv.Atoi(parts[3])
+	if err != nil || mode < 0 || mode >= int(numTransitModes) {
+		s.broadcastToPlayer(playerID, "STATUS:Unknown transit mode!")
+		return
+	}
+	points := make([]float32, 0, len(parts)-4)
+	nodes := make([]rl.Vector2, 0, (len(parts)-4)/2)
+	for i := 4; i < len(parts); i += 2 {
+		x, errX := strconv.ParseFloat(parts[i], 32)
+		y, errY := strconv.ParseFloat(parts[i+1], 32)
+		if errX == nil && errY == nil {
+			points = append(points, float32(x), float32(y))
+			nodes = append(nodes, rl.NewVector2(float32(x), float32(y)))
+		} else {
+			s.broadcastToPlayer(playerID, "STATUS:Invalid coordinates for bus route node.")
+			return
+		}
+	}
+
+	if len(nodes) < 2 {
+		s.broadcastToPlayer(playerID, "STATUS:Bus route needs at least 2 nodes!")
+		return
+	}
+	if loop && len(nodes) < 3 {
+		s.broadcastToPlayer(playerID, "STATUS:Loop route needs at least 3 nodes!")
+		return
+	}
+	if !allOnMap(nodes) {
+		s.broadcastToPlayer(playerID, "STATUS:Routes must stay on the map!")
+		return
+	}
+
+	if !s.isValidRoutePath(TransitMode(mode), nodes, loop) {
+		s.broadcastToPlayer(playerID, "STATUS:Bus and tram routes must be fully on roads!")
+		return
+	}
+	totalLength := routeLength(nodes, loop)
+
+	cost := getTransitVehicleCost(TransitMode(mode)) + totalLength*getTransitTrackCost(TransitMode(mode))
+	if s.money < cost {
+		s.broadcastToPlayer(playerID, fmt.Sprintf("STATUS:Not enough money to build this line! Cost: %.2f", cost))
+		return
+	}
+	s.money -= cost
+	s.broadcastMoney()
+
+	owner := playerID
+	if player, exists := s.players[playerID]; exists {
+		owner = player.Name
+	}
+	newRoute := StoredBusRoute{
+		ID:       s.nextRouteID,
+		Points:   points,
+		PlayerID: playerID,
+		Length:   totalLength,
+		Vehicles: 1,
+		Loop:     loop,
+		Name:     fmt.Sprintf("Route %d", s.nextRouteID+1),
+		Color:    s.nextRouteID % NUM_ROUTE_COLORS,
+		Owner:    owner,
+		Mode:     TransitMode(mode),
+	}
+	s.busRoutes = append(s.busRoutes, newRoute)
+	s.nextRouteID++
+
+	newBus := Bus{
+		RouteID:        len(s.busRoutes) - 1,
+		Position:       nodes[0],
+		CurrentSegment: 0,
+		Progress:       0.0,
+		Direction:      1,
+	}
+	s.buses = append(s.buses, newBus)
+
+	s.broadcastToAll(msg)
+	s.broadcastToAll(busMessage(len(s.buses)-1, newBus))
+	s.broadcastToAll(routeStatsMessage(len(s.busRoutes)-1, newRoute))
+	s.broadcastToAll(routeInfoMessage(len(s.busRoutes)-1, newRoute))
+}
+
+// ownedRoute looks up a route by the index sent by a player and makes sure the
+// player owns it.
+func (s *LobbyServer) ownedRoute(playerID string, routeIndex string) (int, bool) {
+	routeID, err := strconv.Atoi(routeIndex)
+	if err != nil || routeID < 0 || routeID >= len(s.busRoutes) {
+		s.broadcastToPlayer(playerID, "STATUS:Unknown bus route!")
+		return -1, false
+	}
+	if s.busRoutes[routeID].PlayerID != playerID {
+		s.broadcastToPlayer(playerID, "STATUS:You can only change your own bus routes!")
+		return -1, false
+	}
+	return routeID, true
+}
+
+// editBusRoute replaces the nodes of a route after checking the new path is
+// still on roads. Buses stay on their segment where possible so they keep
+// running on the updated path.
+func (s *LobbyServer) editBusRoute(parts []string) {
+	playerID := parts[1]
+	routeID, ok := s.ownedRoute(playerID, parts[2])
+	if !ok {
+		return
+	}
+	route := &s.busRoutes[routeID]
+
+	points := make([]float32, 0, len(parts)-3)
+	nodes := make([]rl.Vector2, 0, (len(parts)-3)/2)
+	for i := 3; i < len(parts); i += 2 {
+		x, errX := strconv.ParseFloat(parts[i], 32)
+		y, errY := strconv.ParseFloat(parts[i+1], 32)
+		if errX != nil || errY != nil {
+			s.broadcastToPlayer(playerID, "STATUS:Invalid coordinates for bus route node.")
+			return
+		}
+		points = append(points, float32(x), float32(y))
+		nodes = append(nodes, rl.NewVector2(float32(x), float32(y)))
+	}
+
+	if route.Loop && len(nodes) < 3 {
+		s.broadcastToPlayer(playerID, "STATUS:Loop route needs at least 3 nodes!")
+		return
+	}
+	if !allOnMap(nodes) {
+		s.broadcastToPlayer(playerID, "STATUS:Routes must stay on the map!")
+		return
+	}
+	if !s.isValidRoutePath(route.Mode, nodes, route.Loop) {
+		s.broadcastToPlayer(playerID, "STATUS:Bus and tram routes must be fully on roads!")
+		return
+	}
+
+	newLength := routeLength(nodes, route.Loop)
+	if cost := max(0, newLength-route.Length) * getTransitTrackCost(route.Mode); cost > 0 {
+		if s.money < cost {
+			s.broadcastToPlayer(playerID, fmt.Sprintf("STATUS:Not enough money to extend this line! Cost: %.2f", cost))
+			return
+		}
+		s.money -= cost
+		s.broadcastMoney()
+	}
+
+	oldNodes := routeNodes(*route)
+	route.Points = points
+	route.Length = newLength
+	s.moveStopsWithNodes(oldNodes, nodes)
+	lastSegment := routeSegments(nodes, route.Loop) - 1
+	for i := range s.buses {
+		bus := &s.buses[i]
+		if bus.RouteID != routeID {
+			continue
+		}
+		if bus.CurrentSegment > lastSegment {
+			bus.CurrentSegment = lastSegment
+		}
+		startNode, endNode := segmentEnds(nodes, bus)
+		bus.Position = rl.Vector2Lerp(startNode, endNode, bus.Progress)
+	}
+	s.broadcastFullState()
+}
+
+func (s *LobbyServer) renameBusRoute(parts []string) {
+	playerID := parts[1]
+	routeID, ok := s.ownedRoute(playerID, parts[2])
+	if !ok {
+		return
+	}
+	name := strings.TrimSpace(parts[3])
+	if name == "" {
+		s.broadcastToPlayer(playerID, "STATUS:Route name can't be empty!")
+		return
+	}
+	if utf8.RuneCountInString(name) > MAX_ROUTE_NAME_LENGTH {
+		name = string([]rune(name)[:MAX_ROUTE_NAME_LENGTH])
+	}
+	s.busRoutes[routeID].Name = name
+	s.broadcastToAll(routeInfoMessage(routeID, s.busRoutes[routeID]))
+}
+
+func (s *LobbyServer) recolorBusRoute(parts []string) {
+	playerID := parts[1]
+	routeID, ok := s.ownedRoute(playerID, parts[2])
+	if !ok {
+		return
+	}
+	color, err := strconv.Atoi(parts[3])
+	if err != nil || color < 0 || color >= NUM_ROUTE_COLORS {
+		s.broadcastToPlayer(playerID, "STATUS:Unknown route color!")
+		return
+	}
+	s.busRoutes[routeID].Color = color
+	s.broadcastToAll(routeInfoMessage(routeID, s.busRoutes[routeID]))
+}
+
+// setRouteVehicles changes the number of buses on a route. Only the owner of
+// the route can do that and new buses have to be bought. All buses of the
+// route are spaced out evenly again afterwards.
+func (s *LobbyServer) setRouteVehicles(parts []string) {
+	playerID := parts[1]
+	routeID, ok := s.ownedRoute(playerID, parts[2])
+	if !ok {
+		return
+	}
+	vehicles, err := strconv.Atoi(parts[3])
+	if err != nil {
+		s.broadcastToPlayer(playerID, "STATUS:Invalid number of buses!")
+		return
+	}
+
+	route := &s.busRoutes[routeID]
+	if vehicles < 1 || vehicles > MAX_BUSES_PER_ROUTE {
+		s.broadcastToPlayer(playerID, fmt.Sprintf("STATUS:A route needs between 1 and %d buses!", MAX_BUSES_PER_ROUTE))
+		return
+	}
+	if vehicles == route.Vehicles {
+		return
+	}
+
+	if vehicles > route.Vehicles {
+		cost := float32(vehicles-route.Vehicles) * getTransitVehicleCost(route.Mode)
+		if s.money < cost {
+			s.broadcastToPlayer(playerID, fmt.Sprintf("STATUS:Not enough money to buy vehicles! Cost: %.2f", cost))
+			return
+		}
+		s.money -= cost
+		s.broadcastMoney()
+	}
+
+	route.Vehicles = vehicles
+	s.spawnBuses(routeID)
+	s.broadcastFullState()
+}
+
+// spawnBuses replaces the buses of a route with route.Vehicles buses spread
+// evenly over a full round trip.
+func (s *LobbyServer) spawnBuses(routeID int) {
+	route := s.busRoutes[routeID]
+	nodes := routeNodes(route)
+
+	newBuses := make([]Bus, 0, len(s.buses)+route.Vehicles)
+	for _, bus := range s.buses {
+		if bus.RouteID != routeID {
+			newBuses = append(newBuses, bus)
+		}
+	}
+
+	roundTrip := 2 * route.Length
+	if route.Loop {
+		roundTrip = route.Length
+	}
+	for k := 0; k < route.Vehicles; k++ {
+		bus := Bus{RouteID: routeID}
+		bus.CurrentSegment, bus.Progress, bus.Direction = routePosition(nodes, route.Loop, roundTrip*float32(k)/float32(route.Vehicles))
+		startNode, endNode := segmentEnds(nodes, &bus)
+		bus.Position = rl.Vector2Lerp(startNode, endNode, bus.Progress)
+		newBuses = append(newBuses, bus)
+	}
+	s.buses = newBuses
+}
+
+func routeNodes(route StoredBusRoute) []rl.Vector2 {
+	nodes := make([]rl.Vector2, len(route.Points)/2)
+	for j := 0; j < len(route.Points); j += 2 {
+		nodes[j/2] = rl.NewVector2(route.Points[j], route.Points[j+1])
+	}
+	return nodes
+}
+
+// routeSegments returns the number of segments of a route. Loop routes have an
+// extra segment from the last node back to the first one.
+func routeSegments(nodes []rl.Vector2, loop bool) int {
+	if loop {
+		return len(nodes)
+	}
+	return len(nodes) - 1
+}
+
+func routeLength(nodes []rl.Vector2, loop bool) float32 {
+	var length float32
+	for j := 0; j < routeSegments(nodes, loop); j++ {
+		length += rl.Vector2Distance(nodes[j], nodes[(j+1)%len(nodes)])
+	}
+	return length
+}
+
+// segmentEnds returns the node a bus is coming from and the node it is heading
+// to.
+func segmentEnds(nodes []rl.Vector2, bus *Bus) (rl.Vector2, rl.Vector2) {
+	next := (bus.CurrentSegment + 1) % len(nodes)
+	if bus.Direction == 1 {
+		return nodes[bus.CurrentSegment], nodes[next]
+	}
+	return nodes[next], nodes[bus.CurrentSegment]
+}
+
+func allOnMap(nodes []rl.Vector2) bool {
+	for _, node := range nodes {
+		if !isOnMap(node) {
+			return false
+		}
+	}
+	return true
+}
+
+// isValidRoutePath checks a route path for its transit mode. Metro lines run
+// underground and don't need roads.
+func (s *LobbyServer) isValidRoutePath(mode TransitMode, nodes []rl.Vector2, loop bool) bool {
+	if mode == MetroTransit {
+		return true
+	}
+	return s.isRouteOnRoads(nodes, loop)
+}
+
+// isRouteOnRoads checks that every segment of a route follows roads in a
+// direction they allow. Buses on back-and-forth routes drive every segment in
+// both directions, so only loops can use one-way roads.
+func (s *LobbyServer) isRouteOnRoads(nodes []rl.Vector2, loop bool) bool {
+	const intermediatePointsPerSegment = 4
+	for j := 0; j < routeSegments(nodes, loop); j++ {
+		segmentStart := nodes[j]
+		segmentEnd := nodes[(j+1)%len(nodes)]
+		direction := rl.Vector2Subtract(segmentEnd, segmentStart)
+
+		for p := 0; p <= intermediatePointsPerSegment; p++ {
+			t := float32(p) / float32(intermediatePointsPerSegment)
+			intermediatePoint := rl.Vector2Lerp(segmentStart, segmentEnd, t)
+			if !s.canDriveAt(intermediatePoint, direction) {
+				return false
+			}
+			if !loop && !s.canDriveAt(intermediatePoint, rl.Vector2Negate(direction)) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// canDriveAt reports whether a road at the position can be driven in the
+// given direction.
+func (s *LobbyServer) canDriveAt(p rl.Vector2, direction rl.Vector2) bool {
+	for _, line := range s.lines {
+		if line.Type != Road {
+			continue
+		}
+		roadStart := rl.NewVector2(line.StartX, line.StartY)
+		roadEnd := rl.NewVector2(line.EndX, line.EndY)
+		if pointSegmentDistance(p, roadStart, roadEnd) > ROAD_SNAP_DISTANCE {
+			continue
+		}
+		if !line.OneWay || rl.Vector2DotProduct(rl.Vector2Subtract(roadEnd, roadStart), direction) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// routePosition finds the segment, progress and direction of a bus that has
+// travelled the given distance from the first node, turning around at the end
+// of the route unless it is a loop.
+func routePosition(nodes []rl.Vector2, loop bool, distance float32) (int, float32, int) {
+	for j := 0; j < routeSegments(nodes, loop); j++ {
+		segmentLength := rl.Vector2Distance(nodes[j], nodes[(j+1)%len(nodes)])
+		if distance < segmentLength {
+			return j, distance / segmentLength, 1
+		}
+		distance -= segmentLength
+	}
+	if loop {
+		return 0, 0, 1
+	}
+	for j := len(nodes) - 2; j >= 0; j-- {
+		segmentLength := rl.Vector2Distance(nodes[j], nodes[j+1])
+		if distance < segmentLength {
+			return j, distance / segmentLength, -1
+		}
+		distance -= segmentLength
+	}
+	return 0, 0, 1
+}
+
+// payOperatingCosts books the operating cost of every bus on its route and
+// returns the total.
+func (s *LobbyServer) payOperatingCosts() float32 {
+	var total float32
+	for i := range s.busRoutes {
+		cost := float32(s.busRoutes[i].Vehicles) * getTransitOperatingCost(s.busRoutes[i].Mode)
+		s.busRoutes[i].OpCost += cost
+		total += cost
+		s.broadcastToAll(routeStatsMessage(i, s.busRoutes[i]))
+	}
+	return total
+}
+
+// moveStopsWithNodes keeps the stops of an edited route on it. A stop on a
+// moved node follows the node, a stop on a removed node is deleted with its
+// waiting passengers, unless another route still passes there.
+func (s *LobbyServer) moveStopsWithNodes(oldNodes, newNodes []rl.Vector2) {
+	for j, old := range oldNodes {
+		if slices.Contains(newNodes, old) {
+			continue
+		}
+		stop := s.stopAt(old.X, old.Y)
+		if stop == -1 || s.isRouteNode(old.X, old.Y) {
+			continue
+		}
+		if len(oldNodes) == len(newNodes) && s.stopAt(newNodes[j].X, newNodes[j].Y) == -1 {
+			s.busStops[stop].X, s.busStops[stop].Y = newNodes[j].X, newNodes[j].Y
+		} else {
+			s.busStops = append(s.busStops[:stop], s.busStops[stop+1:]...)
+		}
+	}
+}
+
+func (s *LobbyServer) stopAt(x, y float32) int {
+	for i, stop := range s.busStops {
+		if rl.Vector2Distance(rl.NewVector2(stop.X, stop.Y), rl.NewVector2(x, y)) < 1 {
+			return i
+		}
+	}
+	return -1
+}
+
+func (s *LobbyServer) isRouteNode(x, y float32) bool {
+	for _, r := range s.busRoutes {
+		for j := 0; j < len(r.Points); j += 2 {
+			if rl.Vector2Distance(rl.NewVector2(r.Points[j], r.Points[j+1]), rl.NewVector2(x, y)) < 1 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// toggleBusStop places a bus stop on a route node, or removes the stop that is
+// already there.
+func (s *LobbyServer) toggleBusStop(parts []string) {
+	playerID := parts[1]
+	x, _ := strconv.ParseFloat(parts[2], 32)
+	y, _ := strconv.ParseFloat(parts[3], 32)
+
+	if idx := s.stopAt(float32(x), float32(y)); idx != -1 {
+		removed := s.busStops[idx]
+		s.busStops = append(s.busStops[:idx], s.busStops[idx+1:]...)
+		removed.Waiting = -1
+		s.broadcastToAll(busStopMessage(removed))
+		return
+	}
+
+	if !s.isRouteNode(float32(x), float32(y)) {
+		s.broadcastToPlayer(playerID, "STATUS:Bus stops must be placed on a route node!")
+		return
+	}
+	newStop := StoredBusStop{X: float32(x), Y: float32(y), PlayerID: playerID}
+	s.busStops = append(s.busStops, newStop)
+	s.broadcastToAll(busStopMessage(newStop))
+}
+
+// updateBusStops sends new passengers to every stop served by a route. The
+// number depends on the commuters using the stop and the shoppers of the
+// Commercial buildings within the catchment radius of the stop.
+func (s *LobbyServer) updateBusStops() {
+	for i := range s.busStops {
+		stop := &s.busStops[i]
+		if !s.isRouteNode(stop.X, stop.Y) {
+			continue
+		}
+
+		catchment := stop.Commuters
+		stopPos := rl.NewVector2(stop.X, stop.Y)
+		for _, b := range s.buildings {
+			if b.Type != Commercial {
+				continue
+			}
+			if rl.Vector2Distance(stopPos, rl.NewVector2(b.X, b.Y)) <= STOP_CATCHMENT_RADIUS {
+				catchment += float32(b.Occupants) * PASSENGERS_PER_OCCUPANT
+			}
+		}
+
+		waiting := min(stop.Waiting+int(math.Ceil(float64(catchment))), MAX_WAITING_PASSENGERS)
+		if waiting != stop.Waiting {
+			stop.Waiting = waiting
+			s.broadcastToAll(busStopMessage(*stop))
+		}
+	}
+}
+
+// stopsAhead counts the bus stops on the route after nodeIndex when travelling
+// in the given direction. On a loop every other stop is ahead.
+func (s *LobbyServer) stopsAhead(route StoredBusRoute, nodeIndex int, direction int) int {
+	count := 0
+	if route.Loop {
+		for n := 0; n < len(route.Points)/2; n++ {
+			if n != nodeIndex && s.stopAt(route.Points[n*2], route.Points[n*2+1]) != -1 {
+				count++
+			}
+		}
+		return count
+	}
+	for n := nodeIndex + direction; n >= 0 && n < len(route.Points)/2; n += direction {
+		if s.stopAt(route.Points[n*2], route.Points[n*2+1]) != -1 {
+			count++
+		}
+	}
+	return count
+}
+
+// serveStop lets passengers get off and on when a bus arrives at a route node
+// with a stop. Passengers spread their trips evenly over the stops ahead and
+// everyone leaves the bus at the end of the line (loops have no end). Every boarding passenger pays
+// the fare.
+func (s *LobbyServer) serveStop(bus *Bus, nodeIndex int, terminal bool) {
+	route := &s.busRoutes[bus.RouteID]
+	ahead := s.stopsAhead(*route, nodeIndex, bus.Direction)
+	stopIdx := s.stopAt(route.Points[nodeIndex*2], route.Points[nodeIndex*2+1])
+
+	if terminal || ahead == 0 {
+		bus.Passengers = 0
+	} else if stopIdx != -1 {
+		bus.Passengers -= int(math.Ceil(float64(bus.Passengers) / float64(ahead+1)))
+	}
+	if stopIdx == -1 || ahead == 0 {
+		return
+	}
+
+	stop := &s.busStops[stopIdx]
+	boarding := min(stop.Waiting, getTransitCapacity(route.Mode)-bus.Passengers)
+	if boarding <= 0 {
+		return
+	}
+	bus.Passengers += boarding
+	stop.Waiting -= boarding
+	fares := float32(boarding) * BUS_FARE
+	route.Riders += boarding
+	route.Revenue += fares
+	s.money += fares
+
+	s.broadcastToAll(busStopMessage(*stop))
+	s.broadcastToAll(routeStatsMessage(bus.RouteID, *route))
+	s.broadcastMoney()
+}
+
+func busStopMessage(stop StoredBusStop) string {
+	return fmt.Sprintf("STOP:%.0f:%.0f:%d", stop.X, stop.Y, stop.Waiting)
+}
+
+func busMessage(index int, bus Bus) string {
+	return fmt.Sprintf("BUS:%d:%.0f:%.0f:%d", index, bus.Position.X, bus.Position.Y, bus.RouteID)
+}
+
+func routeInfoMessage(index int, r StoredBusRoute) string {
+	return fmt.Sprintf("RINFO:%d:%d:%d:%s:%s", index, r.ID, r.Color, r.Owner, r.Name)
+}
+
+func routeStatsMessage(index int, r StoredBusRoute) string {
+	return fmt.Sprintf("RSTATS:%d:%d:%.2f:%d:%.2f:%d:%.0f", index, r.Riders, r.Revenue, r.Vehicles, r.OpCost, r.Trips, r.Length)
+}
+
+func (s *LobbyServer) deleteObject(parts []string) {
+	playerID := parts[1]
+	x, _ := strconv.ParseFloat(parts[2], 32)
+	y, _ := strconv.ParseFloat(parts[3], 32)
+	deleteRadius := float64(GRID_SIZE * 0.75)
+	deletedSomething := false
+
+	deletedRoadIndices := make(map[int]bool)
+
+	for i := len(s.buildings) - 1; i >= 0; i-- {
+		b := s.buildings[i]
+		dist := math.Sqrt(math.Pow(float64(b.X)-x, 2) + math.Pow(float64(b.Y)-y, 2))
+		if dist <= deleteRadius {
+			s.buildings = append(s.buildings[:i], s.buildings[i+1:]...)
+			deletedSomething = true
+			break
+		}
+	}
+
+	if !deletedSomething {
+		for i := len(s.lines) - 1; i >= 0; i-- {
+			l := s.lines[i]
+			distStart := math.Sqrt(math.Pow(float64(l.StartX)-x, 2) + math.Pow(float64(l.StartY)-y, 2))
+			distEnd := math.Sqrt(math.Pow(float64(l.EndX)-x, 2) + math.Pow(float64(l.EndY)-y, 2))
+			lineSegmentDist := pointSegmentDistance(rl.NewVector2(float32(x), float32(y)), rl.NewVector2(l.StartX, l.StartY), rl.NewVector2(l.EndX, l.EndY))
+
+			if distStart <= deleteRadius || distEnd <= deleteRadius || lineSegmentDist <= float32(deleteRadius) {
+				// A road split at a river is deleted with its bridges or tunnels.
+				for j := len(s.lines) - 1; j >= 0; j-- {
+					if j != i && (l.Group == 0 || s.lines[j].Group != l.Group) {
+						continue
+					}
+					if refund := lineCost(s.lines[j]); refund > 0 {
+						s.money += refund
+						s.broadcastMoney()
+					}
+					if s.lines[j].Type == Road {
+						deletedRoadIndices[j] = true
+					}
+					s.lines = append(s.lines[:j], s.lines[j+1:]...)
+				}
 				deletedSomething = true
 				break
 			}
@@ -605,8 +3147,7 @@ func (s *LobbyServer) deleteObject(parts []string) {
 				nodeX, nodeY := r.Points[j], r.Points[j+1]
 				dist := math.Sqrt(math.Pow(float64(nodeX)-x, 2) + math.Pow(float64(nodeY)-y, 2))
 				if dist <= deleteRadius {
-					s.busRoutes = append(s.busRoutes[:i], s.busRoutes[i+1:]...)
-					s.removeBusesForRoute(i)
+					s.deleteBusRoute(i)
 					deletedSomething = true
 					routeDeleted = true
 					break
@@ -622,62 +3163,62 @@ func (s *LobbyServer) deleteObject(parts []string) {
 		routesToPrune := []int{}
 		for i := 0; i < len(s.busRoutes); i++ {
 			route := s.busRoutes[i]
-			routeIsValid := true
-			nodes := make([]rl.Vector2, len(route.Points)/2)
-			for j := 0; j < len(route.Points); j += 2 {
-				nodes[j/2] = rl.NewVector2(route.Points[j], route.Points[j+1])
-			}
-
-			const intermediatePointsPerSegment = 4
-			for j := 0; j < len(nodes)-1; j++ {
-				segmentStart := nodes[j]
-				segmentEnd := nodes[j+1]
-
-				for p := 0; p <= intermediatePointsPerSegment; p++ {
-					t := float32(p) / float32(intermediatePointsPerSegment)
-					intermediatePoint := rl.Vector2Lerp(segmentStart, segmentEnd, t)
-					if !s.isPointOnRoad(intermediatePoint.X, intermediatePoint.Y) {
-						routeIsValid = false
-						break
-					}
-				}
-				if !routeIsValid {
-					break
-				}
-			}
-
-			if !routeIsValid {
+			if !s.isValidRoutePath(route.Mode, routeNodes(route), route.Loop) {
 				routesToPrune = append(routesToPrune, i)
 			}
 		}
 
 		for k := len(routesToPrune) - 1; k >= 0; k-- {
 			idxToRemove := routesToPrune[k]
-			s.busRoutes = append(s.busRoutes[:idxToRemove], s.busRoutes[idxToRemove+1:]...)
-			s.removeBusesForRoute(idxToRemove)
+			s.deleteBusRoute(idxToRemove)
 			deletedSomething = true
 		}
 	}
 
 	if deletedSomething {
-		s.broadcastToAll("STATE_RESET")
-		for clientConn := range s.playerConns {
-			s.sendFullState(clientConn)
-		}
+		s.updateConnectivity()
+		s.broadcastFullState()
 	} else {
 		s.broadcastToPlayer(playerID, "STATUS:No deletable object found here.")
 	}
 }
 
 func pointSegmentDistance(p, a, b rl.Vector2) float32 {
+	return rl.Vector2Distance(p, closestPointOnSegment(p, a, b))
+}
+
+func closestPointOnSegment(p, a, b rl.Vector2) rl.Vector2 {
 	l2 := rl.Vector2DistanceSqr(a, b)
 	if l2 == 0.0 {
-		return rl.Vector2Distance(p, a)
+		return a
 	}
 	t := rl.Vector2DotProduct(rl.Vector2Subtract(p, a), rl.Vector2Subtract(b, a)) / l2
 	t = float32(math.Max(0, math.Min(1, float64(t))))
-	projection := rl.Vector2Add(a, rl.Vector2Scale(rl.Vector2Subtract(b, a), t))
-	return rl.Vector2Distance(p, projection)
+	return rl.Vector2Add(a, rl.Vector2Scale(rl.Vector2Subtract(b, a), t))
+}
+
+func linesTouch(a, b StoredLine) bool {
+	a1, a2 := rl.NewVector2(a.StartX, a.StartY), rl.NewVector2(a.EndX, a.EndY)
+	b1, b2 := rl.NewVector2(b.StartX, b.StartY), rl.NewVector2(b.EndX, b.EndY)
+
+	if pointSegmentDistance(a1, b1, b2) <= ROAD_SNAP_DISTANCE || pointSegmentDistance(a2, b1, b2) <= ROAD_SNAP_DISTANCE ||
+		pointSegmentDistance(b1, a1, a2) <= ROAD_SNAP_DISTANCE || pointSegmentDistance(b2, a1, a2) <= ROAD_SNAP_DISTANCE {
+		return true
+	}
+	var collision rl.Vector2
+	return rl.CheckCollisionLines(a1, a2, b1, b2, &collision)
+}
+
+// deleteBusRoute removes a route with its vehicles and refunds its tram track
+// or metro tunnel, like deleted lines are refunded. Vehicles are not refunded.
+func (s *LobbyServer) deleteBusRoute(index int) {
+	route := s.busRoutes[index]
+	if refund := route.Length * getTransitTrackCost(route.Mode); refund > 0 {
+		s.money += refund
+		s.broadcastMoney()
+	}
+	s.busRoutes = append(s.busRoutes[:index], s.busRoutes[index+1:]...)
+	s.removeBusesForRoute(index)
 }
 
 func (s *LobbyServer) removeBusesForRoute(routeID int) {
@@ -693,6 +3234,13 @@ func (s *LobbyServer) removeBusesForRoute(routeID int) {
 	s.buses = newBuses
 }
 
+func (s *LobbyServer) broadcastFullState() {
+	s.broadcastToAll("STATE_RESET")
+	for clientConn := range s.playerConns {
+		s.sendFullState(clientConn)
+	}
+}
+
 func (s *LobbyServer) broadcastMoney() {
 	s.broadcastToAll(fmt.Sprintf("MONEY:%.2f", s.money))
 }
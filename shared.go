@@ -6,13 +6,213 @@ const (
 	GRID_SIZE                  = 32
 	UI_HEIGHT                  = 120
 	ROAD_COST_PER_UNIT         = 0.5
+	PIPE_COST_PER_UNIT         = 0.25
+	POWER_LINE_COST_PER_UNIT   = 0.3
 	BUS_SPEED                  = 200.0
 	ROAD_SNAP_DISTANCE         = 8.0
+	ROAD_ACCESS_DISTANCE       = GRID_SIZE
 	RESIDENTIAL_BUILDING_COST  = 100.0
 	COMMERCIAL_BUILDING_COST   = 250.0
 	INDUSTRIAL_BUILDING_COST   = 1000.0
+	WATER_PUMP_COST            = 500.0
+	WATER_PUMP_CAPACITY        = 40
+	PUMP_RIVER_DISTANCE        = GRID_SIZE * 1.5
+	POWER_PLANT_COST           = 2000.0
+	POWER_PLANT_CAPACITY       = 100
 	COMMERCIAL_INCOME_INCREASE = 5.0
 	INDUSTRIAL_INCOME_INCREASE = 25.0
+	MAX_ZONE_CELLS             = 1024
+
+	RESIDENTS_PER_BUILDING       = 20
+	COMMERCIAL_JOBS_PER_BUILDING = 10
+	INDUSTRIAL_JOBS_PER_BUILDING = 20
+	WORKFORCE_RATIO              = 0.6
+	COMMERCIAL_JOBS_PER_RESIDENT = 0.2
+	INDUSTRIAL_JOBS_PER_RESIDENT = 0.3
+	BASE_RESIDENTIAL_DEMAND      = 20
+	TRANSIT_SERVICE_DEMAND_BONUS = 0.05
+	MAX_SERVICE_DEMAND_BONUS     = 0.2
+	DEMAND_INCOME_FACTOR         = 0.5
+	MAX_ZONE_GROWTH_PER_TICK     = 3
+	OCCUPANCY_CHANGE_RATE        = 0.25
+	RESIDENTIAL_MOVE_OUT_DEMAND  = -0.5
+	NO_WATER_INCOME_FACTOR       = 0.5
+	NO_WATER_MAX_OCCUPANCY       = 0.5
+
+	BUS_CAPACITY            = 40
+	BUS_FARE                = 2.0
+	STOP_CATCHMENT_RADIUS   = GRID_SIZE * 4
+	PASSENGERS_PER_OCCUPANT = 0.05
+	MAX_WAITING_PASSENGERS  = 100
+	BUS_PURCHASE_COST       = 300.0
+	BUS_OPERATING_COST      = 5.0
+	MAX_BUSES_PER_ROUTE     = 10
+	MAX_ROUTE_NAME_LENGTH   = 20
+	NUM_ROUTE_COLORS        = 8
+
+	AVENUE_COST_PER_UNIT    = 1.0
+	HIGHWAY_COST_PER_UNIT   = 2.0
+	STREET_UPKEEP_PER_UNIT  = 0.005
+	AVENUE_UPKEEP_PER_UNIT  = 0.01
+	HIGHWAY_UPKEEP_PER_UNIT = 0.02
+	STREET_CAPACITY         = 20
+	AVENUE_CAPACITY         = 50
+	HIGHWAY_CAPACITY        = 120
+	STREET_SPEED            = 150.0
+	AVENUE_SPEED            = BUS_SPEED
+	HIGHWAY_SPEED           = 320.0
+	RIVER_HALF_WIDTH        = GRID_SIZE / 2
+	MAX_BRIDGE_LENGTH       = GRID_SIZE * 6
+	BRIDGE_COST_MULTIPLIER  = 4.0
+	TUNNEL_COST_MULTIPLIER  = 8.0
+
+	WALK_SPEED               = 40.0
+	MAX_WALK_DISTANCE        = GRID_SIZE * 8
+	PARKING_TIME             = 5.0
+	TRANSIT_WAIT_TIME        = 3.0
+	MAX_COMMUTE_TIME         = 60.0
+	TRAFFIC_SLOWDOWN         = 0.15
+	MIN_TRAFFIC_SPEED_FACTOR = 0.2
+
+	MAP_SIZE                = GRID_SIZE * 100
+	GOODS_PER_WORKER        = 1.0
+	GOODS_DEMAND_PER_WORKER = 1.5
+	GOODS_PER_TRUCK         = 10.0
+	MAX_TRUCKS              = 50
+	NO_GOODS_INCOME_FACTOR  = 0.25
+	EXPORT_INCOME_FACTOR    = 0.75
+
+	GRID_CELLS                  = MAP_SIZE / GRID_SIZE
+	INDUSTRIAL_POLLUTION        = 20.0
+	INDUSTRIAL_NOISE            = 30.0
+	ROAD_POLLUTION_PER_VEHICLE  = 0.1
+	ROAD_NOISE_PER_VEHICLE      = 1.0
+	POLLUTION_DECAY             = 0.8
+	POLLUTION_SPREAD            = 0.5
+	POLLUTION_SCALE             = 100.0
+	POLLUTION_HAPPINESS_PENALTY = 0.4
+	NOISE_HAPPINESS_PENALTY     = 0.2
+	COMMUTE_HAPPINESS_PENALTY   = 0.3
+	MIN_HAPPY_OCCUPANCY         = 0.5
+
+	MAX_LAND_VALUE          = 100.0
+	ROAD_LAND_VALUE         = 20.0
+	ROAD_LAND_VALUE_RADIUS  = GRID_SIZE * 2
+	WATER_LAND_VALUE        = 25.0
+	WATER_LAND_VALUE_RADIUS = GRID_SIZE * 5
+	TRANSIT_LAND_VALUE      = 25.0
+	POLLUTION_LAND_VALUE    = 40.0
+	NOISE_LAND_VALUE        = 20.0
+	MIN_LAND_VALUE_INCOME   = 0.5
+
+	POLICE_STATION_COST       = 800.0
+	FIRE_STATION_COST         = 800.0
+	CLINIC_COST               = 1200.0
+	SCHOOL_COST               = 1000.0
+	POLICE_OPERATING_COST     = 15.0
+	FIRE_OPERATING_COST       = 15.0
+	CLINIC_OPERATING_COST     = 25.0
+	SCHOOL_OPERATING_COST     = 20.0
+	POLICE_RADIUS             = GRID_SIZE * 10
+	FIRE_RADIUS               = GRID_SIZE * 8
+	CLINIC_RADIUS             = GRID_SIZE * 12
+	SCHOOL_RADIUS             = GRID_SIZE * 10
+	MAX_COVERAGE              = 100.0
+	SERVICE_HAPPINESS_PENALTY = 0.3
+	SERVICE_LAND_VALUE        = 20.0
+
+	PARK_COST                  = 300.0
+	PLAZA_COST                 = 400.0
+	TREE_COST                  = 25.0
+	PARK_RADIUS                = GRID_SIZE * 5
+	PLAZA_RADIUS               = GRID_SIZE * 3
+	TREE_RADIUS                = GRID_SIZE * 2
+	PLAZA_STRENGTH             = 0.75
+	TREE_STRENGTH              = 0.25
+	DECORATION_LAND_VALUE      = 20.0
+	DECORATION_HAPPINESS_BONUS = 0.2
+
+	DEFAULT_TAX_RATE           = 10
+	MAX_TAX_RATE               = 20
+	TAX_HAPPINESS_PENALTY      = 0.3
+	LAND_VALUE_HAPPINESS_BONUS = 0.2
+	MOVE_OUT_HAPPINESS         = 0.3
+
+	ABANDON_AFTER_TICKS  = 36
+	COLLAPSE_AFTER_TICKS = 36
+	MIN_HEALTHY_SUPPLY   = 0.1
+
+	MAX_BUILDING_LEVEL      = 3
+	UPGRADE_COST_MULTIPLIER = 2.0
+
+	TRAM_SPEED                 = 180.0
+	TRAM_CAPACITY              = 120
+	TRAM_PURCHASE_COST         = 800.0
+	TRAM_OPERATING_COST        = 12.0
+	TRAM_TRACK_COST_PER_UNIT   = 1.0
+	METRO_SPEED                = 320.0
+	METRO_CAPACITY             = 300
+	METRO_PURCHASE_COST        = 2000.0
+	METRO_OPERATING_COST       = 30.0
+	METRO_TUNNEL_COST_PER_UNIT = 4.0
+)
+
+type RoadClass int
+
+const (
+	Street RoadClass = iota
+	Avenue
+	Highway
+	numRoadClasses
+)
+
+type CrossingType int
+
+const (
+	NoCrossing CrossingType = iota
+	Bridge
+	Tunnel
+)
+
+func isOnMap(p rl.Vector2) bool {
+	return p.X >= 0 && p.Y >= 0 && p.X < MAP_SIZE && p.Y < MAP_SIZE
+}
+
+// isAtMapEdge reports whether a point on the map is close enough to its border
+// for a road ending there to connect to the outside world.
+func isAtMapEdge(p rl.Vector2) bool {
+	return isOnMap(p) && (p.X <= GRID_SIZE || p.Y <= GRID_SIZE || p.X >= MAP_SIZE-GRID_SIZE || p.Y >= MAP_SIZE-GRID_SIZE)
+}
+
+type HeatmapKind int
+
+const (
+	PollutionHeatmap HeatmapKind = iota
+	NoiseHeatmap
+	LandValueHeatmap
+	PoliceHeatmap
+	FireHeatmap
+	HealthHeatmap
+	EducationHeatmap
+	numHeatmapKinds
+)
+
+type CommuteMode int
+
+const (
+	WalkCommute CommuteMode = iota
+	DriveCommute
+	TransitCommute
+	numCommuteModes
+)
+
+type TransitMode int
+
+const (
+	BusTransit TransitMode = iota
+	TramTransit
+	MetroTransit
+	numTransitModes
 )
 
 type InfrastructureType int
@@ -20,6 +220,8 @@ type InfrastructureType int
 const (
 	Road InfrastructureType = iota
 	Water
+	WaterPipe
+	PowerLine
 )
 
 type BuildingType int
@@ -28,18 +230,62 @@ const (
 	Residential BuildingType = iota
 	Commercial
 	Industrial
+	WaterPump
+	PowerPlant
+	PoliceStation
+	FireStation
+	Clinic
+	School
+	Park
+	Plaza
+	Tree
 )
 
+// NoZone is used as zone type to clear zoned cells.
+const NoZone BuildingType = -1
+
 type Building struct {
+	Position  rl.Vector2
+	Type      BuildingType
+	PlayerID  string
+	Connected bool
+	Occupants int
+	Capacity  int
+	Watered   bool
+	Powered   bool
+	Supply    float32
+	Happiness float32
+	Abandoned bool
+	Decay     float32
+	Level     int
+}
+
+type Zone struct {
 	Position rl.Vector2
 	Type     BuildingType
 	PlayerID string
 }
 
 type BusRoute struct {
+	ID       int
 	Nodes    []rl.Vector2
 	PlayerID string
 	Length   float32
+	Riders   int
+	Revenue  float32
+	Vehicles int
+	OpCost   float32
+	Loop     bool
+	Name     string
+	Color    int
+	Owner    string
+	Trips    int
+	Mode     TransitMode
+}
+
+type BusStop struct {
+	Position rl.Vector2
+	Waiting  int
 }
 
 type Bus struct {
@@ -48,4 +294,5 @@ type Bus struct {
 	CurrentSegment int
 	Progress       float32
 	Direction      int
+	Passengers     int
 }